@@ -2,6 +2,8 @@ package databases
 
 import (
 	"bwrs/tools"
+	"context"
+	"time"
 
 	"k8s.io/klog"
 )
@@ -12,44 +14,101 @@ A global interface has been implemented here
 and all database links need to meet this interface
 add the new method that needs to be called here
 and implement it in the corresponding named file
+every method takes the caller's context, handlers pass the request context
+so a client disconnecting cancels its queries
 */
 type Databases interface {
 	// Init init func conn databases return conn,err
-	Init(config tools.ServiceConfig)
-	EnsureUserLoginTable()
-	GetUserByUsername(username string) (*UserLogin, error)
-	SetUserToken(id int64, token string) error
-	UpsertUser(username string, password string) error
-	EnsureButtonsTable()
-	ListButtons() ([]Button, error)
-	AddButton(name string, url string, typ string) error
-	DeleteButton(id int64) error
-	DatabaseMeta() (DatabaseMeta, error)
-	ListTables() ([]string, error)
-	EnsureLocalIndexBindingTable()
-	CreateLocalIndexTable(table string) error
-	SaveLocalIndexEntries(table string, entries []LocalEntry) error
-	UpsertLocalIndexBinding(table string, displayName string, description string) error
-	ListLocalIndexBindings() ([]LocalIndexBinding, error)
-	GetLocalIndexBinding(table string) (*LocalIndexBinding, error)
-	ListLocalIndexEntries(table string, offset int, limit int) ([]LocalEntry, int, error)
-	CountLocalIndexEntries(table string) (int, error)
-	SearchLocalIndexEntries(table string, q string, offset int, limit int) ([]LocalEntry, int, error)
-	EnsureTagsTables()
-	SearchTags(q string) ([]Tag, error)
-	ListAllTags() ([]Tag, error)
-	AddTag(name string) error
-	UpsertFavorite(dirPath string, originalName string, favoriteName string, description string) error
-	SetDirectoryTags(dirPath string, tags []string) error
-	ListFavorites(q string, page int, pageSize int, tags []string) ([]Favorite, int, error)
-	EnsureDownloadSaveTable()
-	GetDownloadSaveByName(name string) (*DownloadSave, error)
-	InsertDownloadSave(name string, group string, desc string, localAddress string) (int64, error)
-	EnsureAskTable()
-	CreateAsk() (*AskKey, error)
-	ListAsk() ([]AskKey, error)
-	CheckAsk(token string) (bool, error)
-	DeleteAsk(id int64) error
+	Init(ctx context.Context, config tools.ServiceConfig)
+	// Close releases the connection pool on shutdown
+	Close(ctx context.Context) error
+	EnsureUserLoginTable(ctx context.Context)
+	GetUserByUsername(ctx context.Context, username string) (*UserLogin, error)
+	SetUserToken(ctx context.Context, id int64, token string) error
+	ListUsers(ctx context.Context) ([]UserLogin, error)
+	GetUserByID(ctx context.Context, id int64) (*UserLogin, error)
+	CreateUser(ctx context.Context, username string, password string, role string) (int64, error)
+	SetUserRole(ctx context.Context, id int64, role string) error
+	SetUserDisabled(ctx context.Context, id int64, disabled bool) error
+	SetUserPassword(ctx context.Context, id int64, password string) error
+	GetUserByOIDCSubject(ctx context.Context, subject string) (*UserLogin, error)
+	SetUserOIDCSubject(ctx context.Context, id int64, subject string) error
+	EnsureButtonsTable(ctx context.Context)
+	ListButtons(ctx context.Context) ([]Button, error)
+	AddButton(ctx context.Context, name string, url string, typ string) error
+	DeleteButton(ctx context.Context, id int64) error
+	DatabaseMeta(ctx context.Context) (DatabaseMeta, error)
+	ListTables(ctx context.Context) ([]string, error)
+	EnsureLocalIndexBindingTable(ctx context.Context)
+	CreateLocalIndexTable(ctx context.Context, table string) error
+	SaveLocalIndexEntries(ctx context.Context, table string, entries []LocalEntry) error
+	UpsertLocalIndexBinding(ctx context.Context, table string, displayName string, description string) error
+	ListLocalIndexBindings(ctx context.Context) ([]LocalIndexBinding, error)
+	GetLocalIndexBinding(ctx context.Context, table string) (*LocalIndexBinding, error)
+	ListLocalIndexEntries(ctx context.Context, table string, offset int, limit int) ([]LocalEntry, int, error)
+	CountLocalIndexEntries(ctx context.Context, table string) (int, error)
+	SearchLocalIndexEntries(ctx context.Context, table string, q string, filter FileMetaFilter, offset int, limit int) ([]LocalEntry, int, error)
+	EnsureFileMetaTable(ctx context.Context)
+	GetFileMeta(ctx context.Context, paths []string) (map[string]FileMeta, error)
+	SetFileMeta(ctx context.Context, meta FileMeta) error
+	ListAllFileMeta(ctx context.Context) ([]FileMeta, error)
+	EnsureTagsTables(ctx context.Context)
+	SearchTags(ctx context.Context, q string) ([]Tag, error)
+	ListAllTags(ctx context.Context) ([]Tag, error)
+	AddTag(ctx context.Context, name string) error
+	UpsertFavorite(ctx context.Context, dirPath string, originalName string, favoriteName string, description string, ownerID int64) error
+	FavoriteOwners(ctx context.Context, dirHashes []string) (map[string]int64, error)
+	SetDirectoryTags(ctx context.Context, dirPath string, tags []string) error
+	ListFavorites(ctx context.Context, q string, page int, pageSize int, tags []string, ownerID int64) ([]Favorite, int, error)
+	DeleteFavorites(ctx context.Context, dirHashes []string, cleanupTags bool) (int64, error)
+	FavoritesExist(ctx context.Context, dirPaths []string) (map[string]bool, error)
+	RelinkFavorites(ctx context.Context, from string, to string, prefix bool, dryRun bool) ([]FavoriteRelink, error)
+	EnsureDownloadSaveTable(ctx context.Context)
+	GetDownloadSaveByName(ctx context.Context, name string) (*DownloadSave, error)
+	InsertDownloadSave(ctx context.Context, name string, group string, desc string, localAddress string, typ string) (int64, error)
+	GetDownloadSavesByNames(ctx context.Context, names []string) (map[string]DownloadSave, error)
+	InsertDownloadSaves(ctx context.Context, items []DownloadSave) ([]DownloadSaveResult, error)
+	ListDownloadSaves(ctx context.Context, q string, group string, page int, pageSize int) ([]DownloadSave, int, error)
+	GetDownloadSave(ctx context.Context, id int64) (*DownloadSave, error)
+	UpdateDownloadSave(ctx context.Context, id int64, group string, desc string, localAddress string, typ string) error
+	DeleteDownloadSave(ctx context.Context, id int64) error
+	ListDownloadSavesAfter(ctx context.Context, afterID int64, limit int) ([]DownloadSave, error)
+	EnsureDownloadSaveCheckTable(ctx context.Context)
+	SaveDownloadSaveChecks(ctx context.Context, checks []DownloadSaveCheck) error
+	ListDownloadSaveChecks(ctx context.Context, status string, page int, pageSize int) ([]DownloadSaveCheck, int, error)
+	CountDownloadSaveChecks(ctx context.Context) (map[string]int, error)
+	RelocateDownloadSaves(ctx context.Context, typ string, from string, to string, newType string, dryRun bool) ([]DownloadSaveRelocation, error)
+	ListDownloadSaveGroups(ctx context.Context) ([]DownloadSaveGroup, error)
+	EnsureAskTable(ctx context.Context)
+	CreateAsk(ctx context.Context, name string, scopes []string, ttl time.Duration) (*AskKey, error)
+	ListAsk(ctx context.Context) ([]AskKey, error)
+	CheckAsk(ctx context.Context, token string, scope string) (bool, error)
+	RotateAsk(ctx context.Context, id int64, grace time.Duration) (*AskKey, error)
+	DeleteAsk(ctx context.Context, id int64) error
+	EnsureAlbumsTables(ctx context.Context)
+	ListAlbums(ctx context.Context, ownerID int64) ([]Album, error)
+	GetAlbum(ctx context.Context, id int64) (*Album, error)
+	CreateAlbum(ctx context.Context, name string, description string, coverPath string, ownerID int64) (int64, error)
+	UpdateAlbum(ctx context.Context, id int64, name string, description string, coverPath string) error
+	DeleteAlbum(ctx context.Context, id int64) error
+	ReorderAlbums(ctx context.Context, ids []int64) error
+	ListAlbumItems(ctx context.Context, albumID int64) ([]AlbumItem, error)
+	AddAlbumItems(ctx context.Context, albumID int64, items []AlbumItem) (int64, error)
+	RemoveAlbumItems(ctx context.Context, albumID int64, itemIDs []int64) (int64, error)
+	ReorderAlbumItems(ctx context.Context, albumID int64, itemIDs []int64) error
+	EnsureAPITokensTable(ctx context.Context)
+	CreateAPIToken(ctx context.Context, userID int64, name string, ttl time.Duration) (*APIToken, error)
+	ListAPITokens(ctx context.Context, userID int64) ([]APIToken, error)
+	LookupAPIToken(ctx context.Context, token string) (*APIToken, error)
+	RevokeAPIToken(ctx context.Context, id int64, userID int64) (bool, error)
+	EnsureAuditLogTable(ctx context.Context)
+	InsertAuditLog(ctx context.Context, entry AuditLog) error
+	ListAuditLogs(ctx context.Context, filter AuditLogFilter, page int, pageSize int) ([]AuditLog, int, error)
+	PurgeAuditLogs(ctx context.Context, olderThan time.Duration) (int64, error)
+	EnsureAutoTagRulesTable(ctx context.Context)
+	ListAutoTagRules(ctx context.Context) ([]AutoTagRule, error)
+	AddAutoTagRule(ctx context.Context, rule AutoTagRule) (int64, error)
+	DeleteAutoTagRule(ctx context.Context, id int64) error
 }
 
 func NewDatabases(databaseType string) Databases {
@@ -65,11 +124,16 @@ func NewDatabases(databaseType string) Databases {
 	}
 }
 
+// UserLogin Role is admin, editor or viewer, OIDCSubject is "issuer|sub" for users linked to an OpenID provider
 type UserLogin struct {
-	Id       int64
-	Username string
-	Password string
-	Token    string
+	Id          int64
+	Username    string
+	Password    string
+	Token       string
+	Role        string
+	Disabled    bool
+	CreatedAt   string
+	OIDCSubject string
 }
 
 type Button struct {
@@ -93,6 +157,27 @@ type LocalEntry struct {
 	Mtime int64
 }
 
+// FileMeta user supplied rating (1-5, 0 unrated), color label and note of an indexed file
+type FileMeta struct {
+	Path      string
+	Rating    int
+	Color     string
+	Note      string
+	UpdatedAt string
+}
+
+// FileMetaFilter conditions on FileMeta, RatingOp is one of = != > >= < <=
+type FileMetaFilter struct {
+	RatingOp string
+	Rating   int
+	Color    string
+	Note     string
+}
+
+func (f FileMetaFilter) Empty() bool {
+	return f.RatingOp == "" && f.Color == "" && f.Note == ""
+}
+
 type Tag struct {
 	Id   int64
 	Name string
@@ -113,17 +198,152 @@ type Favorite struct {
 	Description  string
 	CreatedAt    string
 	Tags         []string
+	OwnerId      int64
+}
+
+// relink plan kinds, a path carries file_meta, per-file tags and album items but no favorite
+const (
+	RelinkFavorite = "favorite"
+	RelinkPath     = "path"
+)
+
+// FavoriteRelink one favorite or other tracked path moved from OldPath to NewPath
+type FavoriteRelink struct {
+	Kind    string
+	OldPath string
+	NewPath string
+	OldHash string
+	NewHash string
 }
 
+// DownloadSave Type marks the storage a row lives on, so a moved disk can be relocated by type
 type DownloadSave struct {
 	Id           int64
 	Group        string
 	Name         string
 	Desc         string
 	LocalAddress string
+	Type         string
 }
 
+// DownloadSaveCheck result of checking a downloadsave local_address on disk,
+// Status is present, missing, empty (no local_address) or error
+type DownloadSaveCheck struct {
+	DownloadId   int64
+	Name         string
+	LocalAddress string
+	Status       string
+	Size         int64
+	Error        string
+	CheckedAt    string
+}
+
+type DownloadSaveRelocation struct {
+	Id         int64
+	Name       string
+	OldAddress string
+	NewAddress string
+}
+
+// DownloadSaveResult per item outcome of a batch insert, Status is created, exists or failed
+type DownloadSaveResult struct {
+	Name   string
+	Status string
+	Id     int64
+	Error  string
+}
+
+type DownloadSaveGroup struct {
+	Group string
+	Count int
+}
+
+// AskKey downloader key, empty Scopes allows every endpoint and empty ExpiresAt never expires.
+// Only the SHA-256 digest is stored, Ask is filled when the key is created or rotated
+// and Prefix keeps the first characters to tell keys apart.
 type AskKey struct {
-	Id  int64
-	Ask string
+	Id         int64
+	Ask        string
+	Prefix     string
+	Name       string
+	Scopes     []string
+	ExpiresAt  string
+	LastUsedAt string
+	UseCount   int64
+	CreatedAt  string
+}
+
+type Album struct {
+	Id          int64
+	Name        string
+	Description string
+	CoverPath   string
+	Position    int
+	ItemCount   int
+	CreatedAt   string
+	OwnerId     int64
+}
+
+// AlbumItem ItemType is favorite (a favorited directory) or file
+type AlbumItem struct {
+	Id        int64
+	AlbumId   int64
+	ItemType  string
+	Path      string
+	Hash      string
+	Position  int
+	CreatedAt string
+}
+
+type AutoTagRule struct {
+	Id         int64
+	Name       string
+	Tags       []string
+	PathGlob   string
+	PathRegex  string
+	Extensions []string
+	Camera     string
+	DateFrom   string
+	DateTo     string
+	Source     string
+}
+
+// AuditLog one mutating API call, Actor is the username, ask:<prefix> for ask keys
+type AuditLog struct {
+	Id        int64
+	CreatedAt string
+	UserId    int64
+	Actor     string
+	IP        string
+	Method    string
+	Route     string
+	Target    string
+	Status    int
+}
+
+// AuditLogFilter empty fields are ignored, Result is ok (status < 400) or error, From/To are YYYY-MM-DD inclusive
+type AuditLogFilter struct {
+	Actor  string
+	Route  string
+	Method string
+	Result string
+	From   string
+	To     string
+}
+
+// APIToken personal access token of a user, only the SHA-256 digest is stored,
+// Token is filled once at creation. Role and Disabled are those of the owning user.
+type APIToken struct {
+	Id         int64
+	UserId     int64
+	Username   string
+	Role       string
+	Disabled   bool
+	Name       string
+	Token      string
+	Prefix     string
+	ExpiresAt  string
+	LastUsedAt string
+	RevokedAt  string
+	CreatedAt  string
 }
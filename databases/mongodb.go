@@ -4,6 +4,7 @@ import (
 	"bwrs/tools"
 	"context"
 	"fmt"
+	"time"
 
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -18,7 +19,7 @@ type Mongodb struct {
 func NewMongodb() *Mongodb {
 	return &Mongodb{}
 }
-func (m *Mongodb) Init(ServiceConfig tools.ServiceConfig) {
+func (m *Mongodb) Init(ctx context.Context, ServiceConfig tools.ServiceConfig) {
 	var err error
 	klog.V(5).Info("begin exec MongoDB init")
 	klog.Info(ServiceConfig)
@@ -38,12 +39,12 @@ func (m *Mongodb) Init(ServiceConfig tools.ServiceConfig) {
 
 	klog.V(8).Infoln("Connecting to string:", connpath)
 	clientOptions := options.Client().ApplyURI(connpath)
-	m.client, err = mongo.Connect(context.TODO(), clientOptions)
+	m.client, err = mongo.Connect(ctx, clientOptions)
 	if err != nil {
 		klog.Fatal(connpath, err)
 	}
 
-	err = m.client.Ping(context.TODO(), nil)
+	err = m.client.Ping(ctx, nil)
 	if err != nil {
 		klog.Fatal(err)
 	}
@@ -51,78 +52,242 @@ func (m *Mongodb) Init(ServiceConfig tools.ServiceConfig) {
 	klog.V(5).Info("Successfully connected to MongoDB")
 }
 
-func (m *Mongodb) EnsureUserLoginTable() {}
-func (m *Mongodb) GetUserByUsername(username string) (*UserLogin, error) {
+func (m *Mongodb) Close(ctx context.Context) error {
+	if m.client == nil {
+		return nil
+	}
+	return m.client.Disconnect(ctx)
+}
+
+func (m *Mongodb) EnsureUserLoginTable(ctx context.Context) {}
+func (m *Mongodb) GetUserByUsername(ctx context.Context, username string) (*UserLogin, error) {
+	return nil, fmt.Errorf("unsupported")
+}
+func (m *Mongodb) SetUserToken(ctx context.Context, id int64, token string) error {
+	return fmt.Errorf("unsupported")
+}
+func (m *Mongodb) ListUsers(ctx context.Context) ([]UserLogin, error) {
 	return nil, fmt.Errorf("unsupported")
 }
-func (m *Mongodb) SetUserToken(id int64, token string) error { return fmt.Errorf("unsupported") }
-func (m *Mongodb) UpsertUser(username string, password string) error {
+func (m *Mongodb) GetUserByID(ctx context.Context, id int64) (*UserLogin, error) {
+	return nil, fmt.Errorf("unsupported")
+}
+func (m *Mongodb) CreateUser(ctx context.Context, username string, password string, role string) (int64, error) {
+	return 0, fmt.Errorf("unsupported")
+}
+func (m *Mongodb) SetUserRole(ctx context.Context, id int64, role string) error {
 	return fmt.Errorf("unsupported")
 }
-func (m *Mongodb) EnsureButtonsTable()            {}
-func (m *Mongodb) ListButtons() ([]Button, error) { return nil, fmt.Errorf("unsupported") }
-func (m *Mongodb) AddButton(name string, url string, typ string) error {
+func (m *Mongodb) SetUserDisabled(ctx context.Context, id int64, disabled bool) error {
 	return fmt.Errorf("unsupported")
 }
-func (m *Mongodb) DeleteButton(id int64) error { return fmt.Errorf("unsupported") }
-func (m *Mongodb) DatabaseMeta() (DatabaseMeta, error) {
+func (m *Mongodb) SetUserPassword(ctx context.Context, id int64, password string) error {
+	return fmt.Errorf("unsupported")
+}
+func (m *Mongodb) GetUserByOIDCSubject(ctx context.Context, subject string) (*UserLogin, error) {
+	return nil, fmt.Errorf("unsupported")
+}
+func (m *Mongodb) SetUserOIDCSubject(ctx context.Context, id int64, subject string) error {
+	return fmt.Errorf("unsupported")
+}
+func (m *Mongodb) EnsureButtonsTable(ctx context.Context) {}
+func (m *Mongodb) ListButtons(ctx context.Context) ([]Button, error) {
+	return nil, fmt.Errorf("unsupported")
+}
+func (m *Mongodb) AddButton(ctx context.Context, name string, url string, typ string) error {
+	return fmt.Errorf("unsupported")
+}
+func (m *Mongodb) DeleteButton(ctx context.Context, id int64) error { return fmt.Errorf("unsupported") }
+func (m *Mongodb) DatabaseMeta(ctx context.Context) (DatabaseMeta, error) {
 	return DatabaseMeta{Type: "mongodb", Name: m.database, Host: "", Port: 0}, nil
 }
-func (m *Mongodb) ListTables() ([]string, error)            { return nil, fmt.Errorf("unsupported") }
-func (m *Mongodb) EnsureLocalIndexBindingTable()            {}
-func (m *Mongodb) CreateLocalIndexTable(table string) error { return fmt.Errorf("unsupported") }
-func (m *Mongodb) SaveLocalIndexEntries(table string, entries []LocalEntry) error {
+func (m *Mongodb) ListTables(ctx context.Context) ([]string, error) {
+	return nil, fmt.Errorf("unsupported")
+}
+func (m *Mongodb) EnsureLocalIndexBindingTable(ctx context.Context) {}
+func (m *Mongodb) CreateLocalIndexTable(ctx context.Context, table string) error {
+	return fmt.Errorf("unsupported")
+}
+func (m *Mongodb) SaveLocalIndexEntries(ctx context.Context, table string, entries []LocalEntry) error {
 	return fmt.Errorf("unsupported")
 }
-func (m *Mongodb) UpsertLocalIndexBinding(table string, displayName string, description string) error {
+func (m *Mongodb) UpsertLocalIndexBinding(ctx context.Context, table string, displayName string, description string) error {
 	return fmt.Errorf("unsupported")
 }
-func (m *Mongodb) ListLocalIndexBindings() ([]LocalIndexBinding, error) {
+func (m *Mongodb) ListLocalIndexBindings(ctx context.Context) ([]LocalIndexBinding, error) {
 	return nil, fmt.Errorf("unsupported")
 }
-func (m *Mongodb) GetLocalIndexBinding(table string) (*LocalIndexBinding, error) {
+func (m *Mongodb) GetLocalIndexBinding(ctx context.Context, table string) (*LocalIndexBinding, error) {
 	return nil, fmt.Errorf("unsupported")
 }
-func (m *Mongodb) ListLocalIndexEntries(table string, offset int, limit int) ([]LocalEntry, int, error) {
+func (m *Mongodb) ListLocalIndexEntries(ctx context.Context, table string, offset int, limit int) ([]LocalEntry, int, error) {
 	return nil, 0, fmt.Errorf("unsupported")
 }
-func (m *Mongodb) CountLocalIndexEntries(table string) (int, error) {
+func (m *Mongodb) CountLocalIndexEntries(ctx context.Context, table string) (int, error) {
 	return 0, fmt.Errorf("unsupported")
 }
-func (m *Mongodb) SearchLocalIndexEntries(table string, q string, offset int, limit int) ([]LocalEntry, int, error) {
+func (m *Mongodb) SearchLocalIndexEntries(ctx context.Context, table string, q string, filter FileMetaFilter, offset int, limit int) ([]LocalEntry, int, error) {
 	return nil, 0, fmt.Errorf("unsupported")
 }
-func (m *Mongodb) EnsureTagsTables()                  {}
-func (m *Mongodb) SearchTags(q string) ([]Tag, error) { return nil, fmt.Errorf("unsupported") }
-func (m *Mongodb) ListAllTags() ([]Tag, error)        { return nil, fmt.Errorf("unsupported") }
-func (m *Mongodb) AddTag(name string) error           { return fmt.Errorf("unsupported") }
-func (m *Mongodb) UpsertFavorite(dirPath string, originalName string, favoriteName string, description string) error {
+func (m *Mongodb) EnsureFileMetaTable(ctx context.Context) {}
+func (m *Mongodb) GetFileMeta(ctx context.Context, paths []string) (map[string]FileMeta, error) {
+	return nil, fmt.Errorf("unsupported")
+}
+func (m *Mongodb) SetFileMeta(ctx context.Context, meta FileMeta) error {
 	return fmt.Errorf("unsupported")
 }
-func (m *Mongodb) SetDirectoryTags(dirPath string, tags []string) error {
+func (m *Mongodb) ListAllFileMeta(ctx context.Context) ([]FileMeta, error) {
+	return nil, fmt.Errorf("unsupported")
+}
+func (m *Mongodb) EnsureTagsTables(ctx context.Context) {}
+func (m *Mongodb) SearchTags(ctx context.Context, q string) ([]Tag, error) {
+	return nil, fmt.Errorf("unsupported")
+}
+func (m *Mongodb) ListAllTags(ctx context.Context) ([]Tag, error) {
+	return nil, fmt.Errorf("unsupported")
+}
+func (m *Mongodb) AddTag(ctx context.Context, name string) error { return fmt.Errorf("unsupported") }
+func (m *Mongodb) FavoriteOwners(ctx context.Context, dirHashes []string) (map[string]int64, error) {
+	return nil, fmt.Errorf("unsupported")
+}
+func (m *Mongodb) UpsertFavorite(ctx context.Context, dirPath string, originalName string, favoriteName string, description string, ownerID int64) error {
+	return fmt.Errorf("unsupported")
+}
+func (m *Mongodb) SetDirectoryTags(ctx context.Context, dirPath string, tags []string) error {
 	return fmt.Errorf("unsupported")
 }
-func (m *Mongodb) ListFavorites(q string, page int, pageSize int, tags []string) ([]Favorite, int, error) {
+func (m *Mongodb) ListFavorites(ctx context.Context, q string, page int, pageSize int, tags []string, ownerID int64) ([]Favorite, int, error) {
 	return nil, 0, fmt.Errorf("unsupported")
 }
+func (m *Mongodb) DeleteFavorites(ctx context.Context, dirHashes []string, cleanupTags bool) (int64, error) {
+	return 0, fmt.Errorf("unsupported")
+}
+func (m *Mongodb) FavoritesExist(ctx context.Context, dirPaths []string) (map[string]bool, error) {
+	return nil, fmt.Errorf("unsupported")
+}
+func (m *Mongodb) RelinkFavorites(ctx context.Context, from string, to string, prefix bool, dryRun bool) ([]FavoriteRelink, error) {
+	return nil, fmt.Errorf("unsupported")
+}
 
-func (m *Mongodb) EnsureDownloadSaveTable() {}
-func (m *Mongodb) GetDownloadSaveByName(name string) (*DownloadSave, error) {
+func (m *Mongodb) EnsureDownloadSaveTable(ctx context.Context) {}
+func (m *Mongodb) GetDownloadSaveByName(ctx context.Context, name string) (*DownloadSave, error) {
 	return nil, fmt.Errorf("unsupported")
 }
-func (m *Mongodb) InsertDownloadSave(name string, group string, desc string, localAddress string) (int64, error) {
+func (m *Mongodb) InsertDownloadSave(ctx context.Context, name string, group string, desc string, localAddress string, typ string) (int64, error) {
 	return 0, fmt.Errorf("unsupported")
 }
-func (m *Mongodb) EnsureAskTable() {}
-func (m *Mongodb) CreateAsk() (*AskKey, error) {
+func (m *Mongodb) GetDownloadSavesByNames(ctx context.Context, names []string) (map[string]DownloadSave, error) {
 	return nil, fmt.Errorf("unsupported")
 }
-func (m *Mongodb) ListAsk() ([]AskKey, error) {
+func (m *Mongodb) InsertDownloadSaves(ctx context.Context, items []DownloadSave) ([]DownloadSaveResult, error) {
 	return nil, fmt.Errorf("unsupported")
 }
-func (m *Mongodb) CheckAsk(token string) (bool, error) {
+func (m *Mongodb) ListDownloadSaves(ctx context.Context, q string, group string, page int, pageSize int) ([]DownloadSave, int, error) {
+	return nil, 0, fmt.Errorf("unsupported")
+}
+func (m *Mongodb) GetDownloadSave(ctx context.Context, id int64) (*DownloadSave, error) {
+	return nil, fmt.Errorf("unsupported")
+}
+func (m *Mongodb) UpdateDownloadSave(ctx context.Context, id int64, group string, desc string, localAddress string, typ string) error {
+	return fmt.Errorf("unsupported")
+}
+func (m *Mongodb) ListDownloadSavesAfter(ctx context.Context, afterID int64, limit int) ([]DownloadSave, error) {
+	return nil, fmt.Errorf("unsupported")
+}
+func (m *Mongodb) EnsureDownloadSaveCheckTable(ctx context.Context) {}
+func (m *Mongodb) SaveDownloadSaveChecks(ctx context.Context, checks []DownloadSaveCheck) error {
+	return fmt.Errorf("unsupported")
+}
+func (m *Mongodb) ListDownloadSaveChecks(ctx context.Context, status string, page int, pageSize int) ([]DownloadSaveCheck, int, error) {
+	return nil, 0, fmt.Errorf("unsupported")
+}
+func (m *Mongodb) CountDownloadSaveChecks(ctx context.Context) (map[string]int, error) {
+	return nil, fmt.Errorf("unsupported")
+}
+func (m *Mongodb) RelocateDownloadSaves(ctx context.Context, typ string, from string, to string, newType string, dryRun bool) ([]DownloadSaveRelocation, error) {
+	return nil, fmt.Errorf("unsupported")
+}
+func (m *Mongodb) DeleteDownloadSave(ctx context.Context, id int64) error {
+	return fmt.Errorf("unsupported")
+}
+func (m *Mongodb) ListDownloadSaveGroups(ctx context.Context) ([]DownloadSaveGroup, error) {
+	return nil, fmt.Errorf("unsupported")
+}
+func (m *Mongodb) EnsureAskTable(ctx context.Context) {}
+func (m *Mongodb) CreateAsk(ctx context.Context, name string, scopes []string, ttl time.Duration) (*AskKey, error) {
+	return nil, fmt.Errorf("unsupported")
+}
+func (m *Mongodb) ListAsk(ctx context.Context) ([]AskKey, error) {
+	return nil, fmt.Errorf("unsupported")
+}
+func (m *Mongodb) CheckAsk(ctx context.Context, token string, scope string) (bool, error) {
 	return false, fmt.Errorf("unsupported")
 }
-func (m *Mongodb) DeleteAsk(id int64) error {
+func (m *Mongodb) RotateAsk(ctx context.Context, id int64, grace time.Duration) (*AskKey, error) {
+	return nil, fmt.Errorf("unsupported")
+}
+func (m *Mongodb) DeleteAsk(ctx context.Context, id int64) error {
+	return fmt.Errorf("unsupported")
+}
+func (m *Mongodb) EnsureAlbumsTables(ctx context.Context) {}
+func (m *Mongodb) ListAlbums(ctx context.Context, ownerID int64) ([]Album, error) {
+	return nil, fmt.Errorf("unsupported")
+}
+func (m *Mongodb) GetAlbum(ctx context.Context, id int64) (*Album, error) {
+	return nil, fmt.Errorf("unsupported")
+}
+func (m *Mongodb) CreateAlbum(ctx context.Context, name string, description string, coverPath string, ownerID int64) (int64, error) {
+	return 0, fmt.Errorf("unsupported")
+}
+func (m *Mongodb) UpdateAlbum(ctx context.Context, id int64, name string, description string, coverPath string) error {
+	return fmt.Errorf("unsupported")
+}
+func (m *Mongodb) DeleteAlbum(ctx context.Context, id int64) error { return fmt.Errorf("unsupported") }
+func (m *Mongodb) ReorderAlbums(ctx context.Context, ids []int64) error {
+	return fmt.Errorf("unsupported")
+}
+func (m *Mongodb) ListAlbumItems(ctx context.Context, albumID int64) ([]AlbumItem, error) {
+	return nil, fmt.Errorf("unsupported")
+}
+func (m *Mongodb) AddAlbumItems(ctx context.Context, albumID int64, items []AlbumItem) (int64, error) {
+	return 0, fmt.Errorf("unsupported")
+}
+func (m *Mongodb) RemoveAlbumItems(ctx context.Context, albumID int64, itemIDs []int64) (int64, error) {
+	return 0, fmt.Errorf("unsupported")
+}
+func (m *Mongodb) ReorderAlbumItems(ctx context.Context, albumID int64, itemIDs []int64) error {
+	return fmt.Errorf("unsupported")
+}
+func (m *Mongodb) EnsureAPITokensTable(ctx context.Context) {}
+func (m *Mongodb) CreateAPIToken(ctx context.Context, userID int64, name string, ttl time.Duration) (*APIToken, error) {
+	return nil, fmt.Errorf("unsupported")
+}
+func (m *Mongodb) ListAPITokens(ctx context.Context, userID int64) ([]APIToken, error) {
+	return nil, fmt.Errorf("unsupported")
+}
+func (m *Mongodb) LookupAPIToken(ctx context.Context, token string) (*APIToken, error) {
+	return nil, fmt.Errorf("unsupported")
+}
+func (m *Mongodb) RevokeAPIToken(ctx context.Context, id int64, userID int64) (bool, error) {
+	return false, fmt.Errorf("unsupported")
+}
+func (m *Mongodb) EnsureAuditLogTable(ctx context.Context) {}
+func (m *Mongodb) InsertAuditLog(ctx context.Context, entry AuditLog) error {
+	return fmt.Errorf("unsupported")
+}
+func (m *Mongodb) ListAuditLogs(ctx context.Context, filter AuditLogFilter, page int, pageSize int) ([]AuditLog, int, error) {
+	return nil, 0, fmt.Errorf("unsupported")
+}
+func (m *Mongodb) PurgeAuditLogs(ctx context.Context, olderThan time.Duration) (int64, error) {
+	return 0, fmt.Errorf("unsupported")
+}
+func (m *Mongodb) EnsureAutoTagRulesTable(ctx context.Context) {}
+func (m *Mongodb) ListAutoTagRules(ctx context.Context) ([]AutoTagRule, error) {
+	return nil, fmt.Errorf("unsupported")
+}
+func (m *Mongodb) AddAutoTagRule(ctx context.Context, rule AutoTagRule) (int64, error) {
+	return 0, fmt.Errorf("unsupported")
+}
+func (m *Mongodb) DeleteAutoTagRule(ctx context.Context, id int64) error {
 	return fmt.Errorf("unsupported")
 }
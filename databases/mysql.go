@@ -2,12 +2,15 @@ package databases
 
 import (
 	"bwrs/tools"
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
 	"fmt"
+	"sort"
 	"strings"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"k8s.io/klog"
@@ -18,28 +21,41 @@ type Mysql struct {
 	dbName string
 	host   string
 	port   int
+	// queryTimeout bounds each method on top of the caller's context, 0 disables it
+	queryTimeout time.Duration
 }
 
+// defaultQueryTimeout used when database.queryTimeout is not set
+const defaultQueryTimeout = 30 * time.Second
+
 func NewMysql() *Mysql {
 	return &Mysql{}
 }
 
-func (m *Mysql) Init(config tools.ServiceConfig) {
+func (m *Mysql) Init(ctx context.Context, config tools.ServiceConfig) {
 	user := config.Database.Description.Username
 	pass := config.Database.Description.Password
 	m.host = config.Database.Host
 	m.port = int(config.Database.Port)
 	m.dbName = config.Database.Path
+	m.queryTimeout = defaultQueryTimeout
+	if config.Database.QueryTimeout != "" {
+		d, err := time.ParseDuration(config.Database.QueryTimeout)
+		if err != nil || d < 0 {
+			klog.Fatalf("invalid database.queryTimeout %q", config.Database.QueryTimeout)
+		}
+		m.queryTimeout = d
+	}
 
 	dsnServer := fmt.Sprintf("%s:%s@tcp(%s:%d)/?parseTime=true&charset=utf8mb4&multiStatements=true", user, pass, m.host, m.port)
 	dbServer, err := sql.Open("mysql", dsnServer)
 	if err != nil {
 		klog.Fatal(err)
 	}
-	if err = dbServer.Ping(); err != nil {
+	if err = dbServer.PingContext(ctx); err != nil {
 		klog.Fatal(err)
 	}
-	_, err = dbServer.Exec(fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s` DEFAULT CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci", m.dbName))
+	_, err = dbServer.ExecContext(ctx, fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s` DEFAULT CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci", m.dbName))
 	if err != nil {
 		klog.Fatal(err)
 	}
@@ -50,27 +66,87 @@ func (m *Mysql) Init(config tools.ServiceConfig) {
 	if err != nil {
 		klog.Fatal(err)
 	}
-	if err = m.db.Ping(); err != nil {
+	if err = m.db.PingContext(ctx); err != nil {
 		klog.Fatal(err)
 	}
 }
 
-func (m *Mysql) EnsureUserLoginTable() {
-	_, err := m.db.Exec(`CREATE TABLE IF NOT EXISTS userlogin (
+/*
+withTimeout
+Bounds a single method by the query timeout. Schema migrations and bulk writes
+(index entries, batch saves, relink and relocate) are only bounded by the caller's context.
+*/
+func (m *Mysql) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if m.queryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, m.queryTimeout)
+}
+
+func (m *Mysql) Close(ctx context.Context) error {
+	if m.db == nil {
+		return nil
+	}
+	return m.db.Close()
+}
+
+func (m *Mysql) EnsureUserLoginTable(ctx context.Context) {
+	_, err := m.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS userlogin (
   id BIGINT PRIMARY KEY AUTO_INCREMENT,
   username VARCHAR(255) UNIQUE NOT NULL,
   password VARCHAR(255) NOT NULL,
-  token VARCHAR(255) DEFAULT ''
+  token VARCHAR(255) DEFAULT '',
+  role VARCHAR(16) NOT NULL DEFAULT 'viewer',
+  disabled TINYINT(1) NOT NULL DEFAULT 0,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  oidc_subject VARCHAR(255) NULL UNIQUE
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`)
 	if err != nil {
 		klog.Fatal(err)
 	}
+	// Ensure role column exists, users created before roles keep full access
+	var cnt int
+	row := m.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = ? AND table_name = 'userlogin' AND column_name = 'role'", m.dbName)
+	_ = row.Scan(&cnt)
+	if cnt == 0 {
+		if _, err := m.db.ExecContext(ctx, "ALTER TABLE userlogin ADD COLUMN role VARCHAR(16) NOT NULL DEFAULT 'viewer'"); err != nil {
+			klog.Fatal(err)
+		}
+		if _, err := m.db.ExecContext(ctx, "UPDATE userlogin SET role = 'admin'"); err != nil {
+			klog.Fatal(err)
+		}
+	}
+	row = m.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = ? AND table_name = 'userlogin' AND column_name = 'disabled'", m.dbName)
+	cnt = 0
+	_ = row.Scan(&cnt)
+	if cnt == 0 {
+		if _, err := m.db.ExecContext(ctx, "ALTER TABLE userlogin ADD COLUMN disabled TINYINT(1) NOT NULL DEFAULT 0"); err != nil {
+			klog.Fatal(err)
+		}
+	}
+	row = m.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = ? AND table_name = 'userlogin' AND column_name = 'created_at'", m.dbName)
+	cnt = 0
+	_ = row.Scan(&cnt)
+	if cnt == 0 {
+		if _, err := m.db.ExecContext(ctx, "ALTER TABLE userlogin ADD COLUMN created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP"); err != nil {
+			klog.Fatal(err)
+		}
+	}
+	row = m.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = ? AND table_name = 'userlogin' AND column_name = 'oidc_subject'", m.dbName)
+	cnt = 0
+	_ = row.Scan(&cnt)
+	if cnt == 0 {
+		if _, err := m.db.ExecContext(ctx, "ALTER TABLE userlogin ADD COLUMN oidc_subject VARCHAR(255) NULL UNIQUE"); err != nil {
+			klog.Fatal(err)
+		}
+	}
 }
 
-func (m *Mysql) GetUserByUsername(username string) (*UserLogin, error) {
-	row := m.db.QueryRow("SELECT id, username, password, token FROM userlogin WHERE username = ? LIMIT 1", username)
+const userColumns = "id, username, password, COALESCE(token, ''), role, disabled, COALESCE(DATE_FORMAT(created_at, '%Y-%m-%d %H:%i:%s'), ''), COALESCE(oidc_subject, '')"
+
+func scanUser(row interface{ Scan(dest ...any) error }) (*UserLogin, error) {
 	var u UserLogin
-	err := row.Scan(&u.Id, &u.Username, &u.Password, &u.Token)
+	err := row.Scan(&u.Id, &u.Username, &u.Password, &u.Token, &u.Role, &u.Disabled, &u.CreatedAt, &u.OIDCSubject)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -80,19 +156,100 @@ func (m *Mysql) GetUserByUsername(username string) (*UserLogin, error) {
 	return &u, nil
 }
 
-func (m *Mysql) SetUserToken(id int64, token string) error {
-	_, err := m.db.Exec("UPDATE userlogin SET token = ? WHERE id = ?", token, id)
+func (m *Mysql) GetUserByUsername(ctx context.Context, username string) (*UserLogin, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	return scanUser(m.db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM userlogin WHERE username = ? LIMIT 1", username))
+}
+
+func (m *Mysql) GetUserByID(ctx context.Context, id int64) (*UserLogin, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	return scanUser(m.db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM userlogin WHERE id = ? LIMIT 1", id))
+}
+
+func (m *Mysql) ListUsers(ctx context.Context) ([]UserLogin, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, "SELECT "+userColumns+" FROM userlogin ORDER BY id ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []UserLogin
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *u)
+	}
+	return list, nil
+}
+
+func (m *Mysql) SetUserToken(ctx context.Context, id int64, token string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	_, err := m.db.ExecContext(ctx, "UPDATE userlogin SET token = ? WHERE id = ?", token, id)
+	return err
+}
+
+func (m *Mysql) CreateUser(ctx context.Context, username string, password string, role string) (int64, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	hash, err := HashPassword(password)
+	if err != nil {
+		return 0, err
+	}
+	res, err := m.db.ExecContext(ctx, "INSERT INTO userlogin (username, password, role) VALUES (?, ?, ?)", username, hash, role)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (m *Mysql) SetUserRole(ctx context.Context, id int64, role string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	_, err := m.db.ExecContext(ctx, "UPDATE userlogin SET role = ? WHERE id = ?", role, id)
+	return err
+}
+
+func (m *Mysql) SetUserDisabled(ctx context.Context, id int64, disabled bool) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	_, err := m.db.ExecContext(ctx, "UPDATE userlogin SET disabled = ?, token = IF(?, '', token) WHERE id = ?", disabled, disabled, id)
 	return err
 }
 
-func (m *Mysql) UpsertUser(username string, password string) error {
-	_, err := m.db.Exec(`INSERT INTO userlogin (username, password) VALUES (?, ?)
-ON DUPLICATE KEY UPDATE password = VALUES(password)`, username, password)
+// SetUserPassword stores the bcrypt hash and clears the stored token so existing sessions are not reused
+func (m *Mysql) SetUserPassword(ctx context.Context, id int64, password string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = m.db.ExecContext(ctx, "UPDATE userlogin SET password = ?, token = '' WHERE id = ?", hash, id)
+	return err
+}
+
+func (m *Mysql) GetUserByOIDCSubject(ctx context.Context, subject string) (*UserLogin, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	return scanUser(m.db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM userlogin WHERE oidc_subject = ? LIMIT 1", subject))
+}
+
+// SetUserOIDCSubject links a user to an OpenID subject, an empty subject removes the link
+func (m *Mysql) SetUserOIDCSubject(ctx context.Context, id int64, subject string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	_, err := m.db.ExecContext(ctx, "UPDATE userlogin SET oidc_subject = NULLIF(?, '') WHERE id = ?", subject, id)
 	return err
 }
 
-func (m *Mysql) EnsureButtonsTable() {
-	_, err := m.db.Exec(`CREATE TABLE IF NOT EXISTS buttons (
+func (m *Mysql) EnsureButtonsTable(ctx context.Context) {
+	_, err := m.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS buttons (
   id BIGINT PRIMARY KEY AUTO_INCREMENT,
   name VARCHAR(255) NOT NULL,
   url VARCHAR(1024) NOT NULL,
@@ -103,8 +260,10 @@ func (m *Mysql) EnsureButtonsTable() {
 	}
 }
 
-func (m *Mysql) ListButtons() ([]Button, error) {
-	rows, err := m.db.Query("SELECT id, name, url, type FROM buttons ORDER BY id ASC")
+func (m *Mysql) ListButtons(ctx context.Context) ([]Button, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, "SELECT id, name, url, type FROM buttons ORDER BY id ASC")
 	if err != nil {
 		return nil, err
 	}
@@ -120,17 +279,23 @@ func (m *Mysql) ListButtons() ([]Button, error) {
 	return list, nil
 }
 
-func (m *Mysql) AddButton(name string, url string, typ string) error {
-	_, err := m.db.Exec("INSERT INTO buttons (name, url, type) VALUES (?, ?, ?)", name, url, typ)
+func (m *Mysql) AddButton(ctx context.Context, name string, url string, typ string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	_, err := m.db.ExecContext(ctx, "INSERT INTO buttons (name, url, type) VALUES (?, ?, ?)", name, url, typ)
 	return err
 }
 
-func (m *Mysql) DeleteButton(id int64) error {
-	_, err := m.db.Exec("DELETE FROM buttons WHERE id = ?", id)
+func (m *Mysql) DeleteButton(ctx context.Context, id int64) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	_, err := m.db.ExecContext(ctx, "DELETE FROM buttons WHERE id = ?", id)
 	return err
 }
 
-func (m *Mysql) DatabaseMeta() (DatabaseMeta, error) {
+func (m *Mysql) DatabaseMeta(ctx context.Context) (DatabaseMeta, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
 	return DatabaseMeta{
 		Type: "mysql",
 		Name: m.dbName,
@@ -139,8 +304,10 @@ func (m *Mysql) DatabaseMeta() (DatabaseMeta, error) {
 	}, nil
 }
 
-func (m *Mysql) ListTables() ([]string, error) {
-	rows, err := m.db.Query("SHOW TABLES")
+func (m *Mysql) ListTables(ctx context.Context) ([]string, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, "SHOW TABLES")
 	if err != nil {
 		return nil, err
 	}
@@ -156,8 +323,8 @@ func (m *Mysql) ListTables() ([]string, error) {
 	return tables, nil
 }
 
-func (m *Mysql) EnsureLocalIndexBindingTable() {
-	_, err := m.db.Exec(`CREATE TABLE IF NOT EXISTS local_index_bindings (
+func (m *Mysql) EnsureLocalIndexBindingTable(ctx context.Context) {
+	_, err := m.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS local_index_bindings (
   id BIGINT PRIMARY KEY AUTO_INCREMENT,
   table_name VARCHAR(255) UNIQUE NOT NULL,
   display_name VARCHAR(255) NOT NULL,
@@ -169,13 +336,13 @@ func (m *Mysql) EnsureLocalIndexBindingTable() {
 	}
 }
 
-func (m *Mysql) CreateLocalIndexTable(table string) error {
+func (m *Mysql) CreateLocalIndexTable(ctx context.Context, table string) error {
 	for _, ch := range table {
 		if !(ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || ch == '_') {
 			return fmt.Errorf("invalid table")
 		}
 	}
-	_, err := m.db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	_, err := m.db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
   id BIGINT PRIMARY KEY AUTO_INCREMENT,
   path TEXT NOT NULL,
   type VARCHAR(16) NOT NULL,
@@ -185,23 +352,23 @@ func (m *Mysql) CreateLocalIndexTable(table string) error {
 	return err
 }
 
-func (m *Mysql) SaveLocalIndexEntries(table string, entries []LocalEntry) error {
+func (m *Mysql) SaveLocalIndexEntries(ctx context.Context, table string, entries []LocalEntry) error {
 	for _, ch := range table {
 		if !(ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || ch == '_') {
 			return fmt.Errorf("invalid table")
 		}
 	}
-	tx, err := m.db.Begin()
+	tx, err := m.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	stmt, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s (path, type, size, mtime) VALUES (?, ?, ?, ?)", table))
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf("INSERT INTO %s (path, type, size, mtime) VALUES (?, ?, ?, ?)", table))
 	if err != nil {
 		_ = tx.Rollback()
 		return err
 	}
 	for _, e := range entries {
-		if _, err := stmt.Exec(e.Path, e.Type, e.Size, e.Mtime); err != nil {
+		if _, err := stmt.ExecContext(ctx, e.Path, e.Type, e.Size, e.Mtime); err != nil {
 			_ = stmt.Close()
 			_ = tx.Rollback()
 			return err
@@ -211,17 +378,22 @@ func (m *Mysql) SaveLocalIndexEntries(table string, entries []LocalEntry) error
 	return tx.Commit()
 }
 
-func (m *Mysql) UpsertLocalIndexBinding(table string, displayName string, description string) error {
-	m.EnsureLocalIndexBindingTable()
-	_, err := m.db.Exec(`INSERT INTO local_index_bindings (table_name, display_name, description)
+func (m *Mysql) UpsertLocalIndexBinding(ctx context.Context, table string, displayName string, description string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	// schema checks are fatal on error, so they never see the request cancellation
+	m.EnsureLocalIndexBindingTable(context.WithoutCancel(ctx))
+	_, err := m.db.ExecContext(ctx, `INSERT INTO local_index_bindings (table_name, display_name, description)
 VALUES (?, ?, ?)
 ON DUPLICATE KEY UPDATE display_name = VALUES(display_name), description = VALUES(description)`, table, displayName, description)
 	return err
 }
 
-func (m *Mysql) ListLocalIndexBindings() ([]LocalIndexBinding, error) {
-	m.EnsureLocalIndexBindingTable()
-	rows, err := m.db.Query("SELECT table_name, display_name, description, DATE_FORMAT(created_at, '%Y-%m-%d %H:%i:%s') FROM local_index_bindings ORDER BY created_at DESC, table_name ASC")
+func (m *Mysql) ListLocalIndexBindings(ctx context.Context) ([]LocalIndexBinding, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	m.EnsureLocalIndexBindingTable(context.WithoutCancel(ctx))
+	rows, err := m.db.QueryContext(ctx, "SELECT table_name, display_name, description, DATE_FORMAT(created_at, '%Y-%m-%d %H:%i:%s') FROM local_index_bindings ORDER BY created_at DESC, table_name ASC")
 	if err != nil {
 		return nil, err
 	}
@@ -237,14 +409,16 @@ func (m *Mysql) ListLocalIndexBindings() ([]LocalIndexBinding, error) {
 	return list, nil
 }
 
-func (m *Mysql) GetLocalIndexBinding(table string) (*LocalIndexBinding, error) {
-	m.EnsureLocalIndexBindingTable()
+func (m *Mysql) GetLocalIndexBinding(ctx context.Context, table string) (*LocalIndexBinding, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	m.EnsureLocalIndexBindingTable(context.WithoutCancel(ctx))
 	for _, ch := range table {
 		if !(ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || ch == '_') {
 			return nil, fmt.Errorf("invalid table")
 		}
 	}
-	row := m.db.QueryRow("SELECT table_name, display_name, description, DATE_FORMAT(created_at, '%Y-%m-%d %H:%i:%s') FROM local_index_bindings WHERE table_name = ? LIMIT 1", table)
+	row := m.db.QueryRowContext(ctx, "SELECT table_name, display_name, description, DATE_FORMAT(created_at, '%Y-%m-%d %H:%i:%s') FROM local_index_bindings WHERE table_name = ? LIMIT 1", table)
 	var b LocalIndexBinding
 	if err := row.Scan(&b.TableName, &b.DisplayName, &b.Description, &b.CreatedAt); err != nil {
 		if err == sql.ErrNoRows {
@@ -255,7 +429,9 @@ func (m *Mysql) GetLocalIndexBinding(table string) (*LocalIndexBinding, error) {
 	return &b, nil
 }
 
-func (m *Mysql) ListLocalIndexEntries(table string, offset int, limit int) ([]LocalEntry, int, error) {
+func (m *Mysql) ListLocalIndexEntries(ctx context.Context, table string, offset int, limit int) ([]LocalEntry, int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
 	for _, ch := range table {
 		if !(ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || ch == '_') {
 			return nil, 0, fmt.Errorf("invalid table")
@@ -268,10 +444,10 @@ func (m *Mysql) ListLocalIndexEntries(table string, offset int, limit int) ([]Lo
 		offset = 0
 	}
 	var total int
-	row := m.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", table))
+	row := m.db.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM %s", table))
 	_ = row.Scan(&total)
 	query := fmt.Sprintf("SELECT path, type, size, mtime FROM %s ORDER BY id ASC LIMIT ? OFFSET ?", table)
-	rows, err := m.db.Query(query, limit, offset)
+	rows, err := m.db.QueryContext(ctx, query, limit, offset)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -287,21 +463,25 @@ func (m *Mysql) ListLocalIndexEntries(table string, offset int, limit int) ([]Lo
 	return list, total, nil
 }
 
-func (m *Mysql) CountLocalIndexEntries(table string) (int, error) {
+func (m *Mysql) CountLocalIndexEntries(ctx context.Context, table string) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
 	for _, ch := range table {
 		if !(ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || ch == '_') {
 			return 0, fmt.Errorf("invalid table")
 		}
 	}
 	var total int
-	row := m.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", table))
+	row := m.db.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM %s", table))
 	if err := row.Scan(&total); err != nil {
 		return 0, err
 	}
 	return total, nil
 }
 
-func (m *Mysql) SearchLocalIndexEntries(table string, q string, offset int, limit int) ([]LocalEntry, int, error) {
+func (m *Mysql) SearchLocalIndexEntries(ctx context.Context, table string, q string, filter FileMetaFilter, offset int, limit int) ([]LocalEntry, int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
 	for _, ch := range table {
 		if !(ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || ch == '_') {
 			return nil, 0, fmt.Errorf("invalid table")
@@ -313,11 +493,35 @@ func (m *Mysql) SearchLocalIndexEntries(table string, q string, offset int, limi
 	if offset < 0 {
 		offset = 0
 	}
+	from := table + " t"
+	where := "t.path LIKE ?"
+	args := []interface{}{"%" + q + "%"}
+	if !filter.Empty() {
+		// files without metadata still match rating filters with an unset rating of 0
+		from += " LEFT JOIN file_meta fm ON fm.path_hash = SHA2(t.path, 256)"
+		if filter.RatingOp != "" {
+			switch filter.RatingOp {
+			case "=", "!=", ">", ">=", "<", "<=":
+			default:
+				return nil, 0, fmt.Errorf("invalid rating operator")
+			}
+			where += " AND COALESCE(fm.rating, 0) " + filter.RatingOp + " ?"
+			args = append(args, filter.Rating)
+		}
+		if filter.Color != "" {
+			where += " AND fm.color = ?"
+			args = append(args, filter.Color)
+		}
+		if filter.Note != "" {
+			where += " AND fm.note LIKE ?"
+			args = append(args, "%"+filter.Note+"%")
+		}
+	}
 	var total int
-	row := m.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE path LIKE ?", table), "%"+q+"%")
+	row := m.db.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s", from, where), args...)
 	_ = row.Scan(&total)
-	query := fmt.Sprintf("SELECT path, type, size, mtime FROM %s WHERE path LIKE ? ORDER BY id ASC LIMIT ? OFFSET ?", table)
-	rows, err := m.db.Query(query, "%"+q+"%", limit, offset)
+	query := fmt.Sprintf("SELECT t.path, t.type, t.size, t.mtime FROM %s WHERE %s ORDER BY t.id ASC LIMIT ? OFFSET ?", from, where)
+	rows, err := m.db.QueryContext(ctx, query, append(args, limit, offset)...)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -333,27 +537,102 @@ func (m *Mysql) SearchLocalIndexEntries(table string, q string, offset int, limi
 	return list, total, nil
 }
 
-func (m *Mysql) EnsureTagsTables() {
-	_, err := m.db.Exec(`CREATE TABLE IF NOT EXISTS tags (
+func (m *Mysql) EnsureFileMetaTable(ctx context.Context) {
+	_, err := m.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS file_meta (
+  path_hash CHAR(64) PRIMARY KEY,
+  path TEXT NOT NULL,
+  rating TINYINT NOT NULL DEFAULT 0,
+  color VARCHAR(16) NOT NULL DEFAULT '',
+  note TEXT,
+  updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  INDEX idx_rating (rating),
+  INDEX idx_color (color)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`)
+	if err != nil {
+		klog.Fatal(err)
+	}
+}
+
+func (m *Mysql) GetFileMeta(ctx context.Context, paths []string) (map[string]FileMeta, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	out := make(map[string]FileMeta, len(paths))
+	if len(paths) == 0 {
+		return out, nil
+	}
+	hashes := make([]string, 0, len(paths))
+	for _, p := range paths {
+		hashes = append(hashes, DirHash(p))
+	}
+	place := strings.TrimSuffix(strings.Repeat("?,", len(hashes)), ",")
+	rows, err := m.db.QueryContext(ctx, "SELECT path, rating, color, COALESCE(note, ''), DATE_FORMAT(updated_at, '%Y-%m-%d %H:%i:%s') FROM file_meta WHERE path_hash IN ("+place+")", toAnySlice(hashes)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var f FileMeta
+		if err := rows.Scan(&f.Path, &f.Rating, &f.Color, &f.Note, &f.UpdatedAt); err != nil {
+			return nil, err
+		}
+		out[f.Path] = f
+	}
+	return out, nil
+}
+
+// SetFileMeta upserts the meta of a path, a meta without rating, color and note removes the row
+func (m *Mysql) SetFileMeta(ctx context.Context, meta FileMeta) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	if meta.Rating == 0 && meta.Color == "" && meta.Note == "" {
+		_, err := m.db.ExecContext(ctx, "DELETE FROM file_meta WHERE path_hash = ?", DirHash(meta.Path))
+		return err
+	}
+	_, err := m.db.ExecContext(ctx, `INSERT INTO file_meta (path_hash, path, rating, color, note) VALUES (?, ?, ?, ?, ?)
+ON DUPLICATE KEY UPDATE rating = VALUES(rating), color = VALUES(color), note = VALUES(note)`,
+		DirHash(meta.Path), meta.Path, meta.Rating, meta.Color, meta.Note)
+	return err
+}
+
+func (m *Mysql) ListAllFileMeta(ctx context.Context) ([]FileMeta, error) {
+	rows, err := m.db.QueryContext(ctx, "SELECT path, rating, color, COALESCE(note, ''), DATE_FORMAT(updated_at, '%Y-%m-%d %H:%i:%s') FROM file_meta ORDER BY path ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []FileMeta
+	for rows.Next() {
+		var f FileMeta
+		if err := rows.Scan(&f.Path, &f.Rating, &f.Color, &f.Note, &f.UpdatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, f)
+	}
+	return list, nil
+}
+
+func (m *Mysql) EnsureTagsTables(ctx context.Context) {
+	_, err := m.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS tags (
   id BIGINT PRIMARY KEY AUTO_INCREMENT,
   name VARCHAR(255) UNIQUE NOT NULL
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`)
 	if err != nil {
 		klog.Fatal(err)
 	}
-	_, err = m.db.Exec(`CREATE TABLE IF NOT EXISTS favorites (
+	_, err = m.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS favorites (
   id BIGINT PRIMARY KEY AUTO_INCREMENT,
   dir_path TEXT NOT NULL,
   dir_hash CHAR(64) UNIQUE NOT NULL,
   original_name VARCHAR(255) NOT NULL,
   favorite_name VARCHAR(255) NOT NULL,
   description TEXT,
+  owner_id BIGINT NULL,
   created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`)
 	if err != nil {
 		klog.Fatal(err)
 	}
-	_, err = m.db.Exec(`CREATE TABLE IF NOT EXISTS dir_tag_map (
+	_, err = m.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS dir_tag_map (
   id BIGINT PRIMARY KEY AUTO_INCREMENT,
   dir_hash CHAR(64) NOT NULL,
   tag_id BIGINT NOT NULL,
@@ -365,48 +644,59 @@ func (m *Mysql) EnsureTagsTables() {
 	}
 	// Ensure favorites.dir_hash exists and backfill
 	var cnt int
-	row := m.db.QueryRow("SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = ? AND table_name = 'favorites' AND column_name = 'dir_hash'", m.dbName)
+	row := m.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = ? AND table_name = 'favorites' AND column_name = 'dir_hash'", m.dbName)
 	_ = row.Scan(&cnt)
 	if cnt == 0 {
-		if _, err := m.db.Exec("ALTER TABLE favorites ADD COLUMN dir_hash CHAR(64)"); err != nil {
+		if _, err := m.db.ExecContext(ctx, "ALTER TABLE favorites ADD COLUMN dir_hash CHAR(64)"); err != nil {
 			klog.Fatal(err)
 		}
 	}
-	if _, err := m.db.Exec("UPDATE favorites SET dir_hash = SHA2(dir_path, 256) WHERE dir_hash IS NULL OR dir_hash = ''"); err != nil {
+	if _, err := m.db.ExecContext(ctx, "UPDATE favorites SET dir_hash = SHA2(dir_path, 256) WHERE dir_hash IS NULL OR dir_hash = ''"); err != nil {
 		klog.Fatal(err)
 	}
 	// Ensure unique index on favorites.dir_hash
-	row = m.db.QueryRow("SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema = ? AND table_name = 'favorites' AND index_name = 'uniq_dir_hash'", m.dbName)
+	row = m.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema = ? AND table_name = 'favorites' AND index_name = 'uniq_dir_hash'", m.dbName)
 	cnt = 0
 	_ = row.Scan(&cnt)
 	if cnt == 0 {
-		if _, err := m.db.Exec("ALTER TABLE favorites ADD UNIQUE KEY uniq_dir_hash (dir_hash)"); err != nil {
+		if _, err := m.db.ExecContext(ctx, "ALTER TABLE favorites ADD UNIQUE KEY uniq_dir_hash (dir_hash)"); err != nil {
 			klog.Fatal(err)
 		}
 	}
 	// Ensure dir_tag_map.dir_hash exists and unique index on (dir_hash, tag_id)
-	row = m.db.QueryRow("SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = ? AND table_name = 'dir_tag_map' AND column_name = 'dir_hash'", m.dbName)
+	row = m.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = ? AND table_name = 'dir_tag_map' AND column_name = 'dir_hash'", m.dbName)
 	cnt = 0
 	_ = row.Scan(&cnt)
 	if cnt == 0 {
-		if _, err := m.db.Exec("ALTER TABLE dir_tag_map ADD COLUMN dir_hash CHAR(64)"); err != nil {
+		if _, err := m.db.ExecContext(ctx, "ALTER TABLE dir_tag_map ADD COLUMN dir_hash CHAR(64)"); err != nil {
 			klog.Fatal(err)
 		}
 		// Backfill dir_hash from dir_path if present
-		_, _ = m.db.Exec("UPDATE dir_tag_map SET dir_hash = SHA2(dir_path, 256) WHERE dir_hash IS NULL OR dir_hash = ''")
+		_, _ = m.db.ExecContext(ctx, "UPDATE dir_tag_map SET dir_hash = SHA2(dir_path, 256) WHERE dir_hash IS NULL OR dir_hash = ''")
+	}
+	row = m.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema = ? AND table_name = 'dir_tag_map' AND index_name = 'uniq_dir_tag'", m.dbName)
+	cnt = 0
+	_ = row.Scan(&cnt)
+	if cnt == 0 {
+		if _, err := m.db.ExecContext(ctx, "ALTER TABLE dir_tag_map ADD UNIQUE KEY uniq_dir_tag (dir_hash, tag_id)"); err != nil {
+			klog.Fatal(err)
+		}
 	}
-	row = m.db.QueryRow("SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema = ? AND table_name = 'dir_tag_map' AND index_name = 'uniq_dir_tag'", m.dbName)
+	// Ensure favorites.owner_id exists, favorites saved before users had owners stay unowned
+	row = m.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = ? AND table_name = 'favorites' AND column_name = 'owner_id'", m.dbName)
 	cnt = 0
 	_ = row.Scan(&cnt)
 	if cnt == 0 {
-		if _, err := m.db.Exec("ALTER TABLE dir_tag_map ADD UNIQUE KEY uniq_dir_tag (dir_hash, tag_id)"); err != nil {
+		if _, err := m.db.ExecContext(ctx, "ALTER TABLE favorites ADD COLUMN owner_id BIGINT NULL"); err != nil {
 			klog.Fatal(err)
 		}
 	}
 }
 
-func (m *Mysql) SearchTags(q string) ([]Tag, error) {
-	rows, err := m.db.Query("SELECT id, name FROM tags WHERE name LIKE ? ORDER BY name ASC LIMIT 20", "%"+q+"%")
+func (m *Mysql) SearchTags(ctx context.Context, q string) ([]Tag, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, "SELECT id, name FROM tags WHERE name LIKE ? ORDER BY name ASC LIMIT 20", "%"+q+"%")
 	if err != nil {
 		return nil, err
 	}
@@ -422,8 +712,10 @@ func (m *Mysql) SearchTags(q string) ([]Tag, error) {
 	return list, nil
 }
 
-func (m *Mysql) ListAllTags() ([]Tag, error) {
-	rows, err := m.db.Query("SELECT id, name FROM tags ORDER BY name ASC")
+func (m *Mysql) ListAllTags(ctx context.Context) ([]Tag, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, "SELECT id, name FROM tags ORDER BY name ASC")
 	if err != nil {
 		return nil, err
 	}
@@ -439,43 +731,72 @@ func (m *Mysql) ListAllTags() ([]Tag, error) {
 	return list, nil
 }
 
-func (m *Mysql) AddTag(name string) error {
-	_, err := m.db.Exec("INSERT IGNORE INTO tags (name) VALUES (?)", name)
+func (m *Mysql) AddTag(ctx context.Context, name string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	_, err := m.db.ExecContext(ctx, "INSERT IGNORE INTO tags (name) VALUES (?)", name)
 	return err
 }
 
-func (m *Mysql) UpsertFavorite(dirPath string, originalName string, favoriteName string, description string) error {
-	h := sha256.Sum256([]byte(dirPath))
-	dirHash := hex.EncodeToString(h[:])
-	_, err := m.db.Exec(`INSERT INTO favorites (dir_path, dir_hash, original_name, favorite_name, description)
-VALUES (?, ?, ?, ?, ?)
+// UpsertFavorite the owner is only set when the favorite is created
+func (m *Mysql) UpsertFavorite(ctx context.Context, dirPath string, originalName string, favoriteName string, description string, ownerID int64) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	_, err := m.db.ExecContext(ctx, `INSERT INTO favorites (dir_path, dir_hash, original_name, favorite_name, description, owner_id)
+VALUES (?, ?, ?, ?, ?, NULLIF(?, 0))
 ON DUPLICATE KEY UPDATE favorite_name = VALUES(favorite_name), description = VALUES(description)`,
-		dirPath, dirHash, originalName, favoriteName, description)
+		dirPath, DirHash(dirPath), originalName, favoriteName, description, ownerID)
 	return err
 }
 
-func (m *Mysql) SetDirectoryTags(dirPath string, tags []string) error {
-	tx, err := m.db.Begin()
+// FavoriteOwners owner id of every existing favorite keyed by dir_hash, unowned favorites map to 0
+func (m *Mysql) FavoriteOwners(ctx context.Context, dirHashes []string) (map[string]int64, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	out := make(map[string]int64, len(dirHashes))
+	if len(dirHashes) == 0 {
+		return out, nil
+	}
+	place := strings.TrimSuffix(strings.Repeat("?,", len(dirHashes)), ",")
+	rows, err := m.db.QueryContext(ctx, "SELECT dir_hash, COALESCE(owner_id, 0) FROM favorites WHERE dir_hash IN ("+place+")", toAnySlice(dirHashes)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash string
+		var owner int64
+		if err := rows.Scan(&hash, &owner); err != nil {
+			return nil, err
+		}
+		out[hash] = owner
+	}
+	return out, nil
+}
+
+func (m *Mysql) SetDirectoryTags(ctx context.Context, dirPath string, tags []string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	tx, err := m.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	h := sha256.Sum256([]byte(dirPath))
-	dirHash := hex.EncodeToString(h[:])
+	hash := DirHash(dirPath)
 	for _, name := range tags {
 		if name == "" {
 			continue
 		}
-		if _, err := tx.Exec("INSERT IGNORE INTO tags (name) VALUES (?)", strings.TrimSpace(name)); err != nil {
+		if _, err := tx.ExecContext(ctx, "INSERT IGNORE INTO tags (name) VALUES (?)", strings.TrimSpace(name)); err != nil {
 			_ = tx.Rollback()
 			return err
 		}
 		var tagID int64
-		row := tx.QueryRow("SELECT id FROM tags WHERE name = ? LIMIT 1", strings.TrimSpace(name))
+		row := tx.QueryRowContext(ctx, "SELECT id FROM tags WHERE name = ? LIMIT 1", strings.TrimSpace(name))
 		if err := row.Scan(&tagID); err != nil {
 			_ = tx.Rollback()
 			return err
 		}
-		if _, err := tx.Exec("INSERT IGNORE INTO dir_tag_map (dir_hash, tag_id) VALUES (?, ?)", dirHash, tagID); err != nil {
+		if _, err := tx.ExecContext(ctx, "INSERT IGNORE INTO dir_tag_map (dir_hash, tag_id) VALUES (?, ?)", hash, tagID); err != nil {
 			_ = tx.Rollback()
 			return err
 		}
@@ -483,7 +804,10 @@ func (m *Mysql) SetDirectoryTags(dirPath string, tags []string) error {
 	return tx.Commit()
 }
 
-func (m *Mysql) ListFavorites(q string, page int, pageSize int, tags []string) ([]Favorite, int, error) {
+// ListFavorites ownerID greater than zero only returns the favorites of that user
+func (m *Mysql) ListFavorites(ctx context.Context, q string, page int, pageSize int, tags []string, ownerID int64) ([]Favorite, int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
 	if page <= 0 {
 		page = 1
 	}
@@ -498,6 +822,10 @@ func (m *Mysql) ListFavorites(q string, page int, pageSize int, tags []string) (
 		pat := "%" + q + "%"
 		args = append(args, pat, pat, pat, pat)
 	}
+	if ownerID > 0 {
+		where += " AND owner_id = ?"
+		args = append(args, ownerID)
+	}
 	tagFilter := ""
 	if len(tags) > 0 {
 		place := make([]string, 0, len(tags))
@@ -516,13 +844,13 @@ func (m *Mysql) ListFavorites(q string, page int, pageSize int, tags []string) (
 	}
 	var total int
 	countSQL := "SELECT COUNT(*) FROM favorites WHERE " + where + tagFilter
-	row := m.db.QueryRow(countSQL, args...)
+	row := m.db.QueryRowContext(ctx, countSQL, args...)
 	if err := row.Scan(&total); err != nil {
 		return nil, 0, err
 	}
-	query := "SELECT dir_path, dir_hash, original_name, favorite_name, description, DATE_FORMAT(created_at, '%Y-%m-%d %H:%i:%s') FROM favorites WHERE " + where + tagFilter + " ORDER BY created_at DESC, favorite_name ASC LIMIT ? OFFSET ?"
+	query := "SELECT dir_path, dir_hash, original_name, favorite_name, description, DATE_FORMAT(created_at, '%Y-%m-%d %H:%i:%s'), COALESCE(owner_id, 0) FROM favorites WHERE " + where + tagFilter + " ORDER BY created_at DESC, favorite_name ASC LIMIT ? OFFSET ?"
 	argsQ := append(args, pageSize, offset)
-	rows, err := m.db.Query(query, argsQ...)
+	rows, err := m.db.QueryContext(ctx, query, argsQ...)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -530,10 +858,10 @@ func (m *Mysql) ListFavorites(q string, page int, pageSize int, tags []string) (
 	var list []Favorite
 	for rows.Next() {
 		var f Favorite
-		if err := rows.Scan(&f.DirPath, &f.DirHash, &f.OriginalName, &f.FavoriteName, &f.Description, &f.CreatedAt); err != nil {
+		if err := rows.Scan(&f.DirPath, &f.DirHash, &f.OriginalName, &f.FavoriteName, &f.Description, &f.CreatedAt, &f.OwnerId); err != nil {
 			return nil, 0, err
 		}
-		trows, terr := m.db.Query("SELECT t.name FROM dir_tag_map dt JOIN tags t ON dt.tag_id = t.id WHERE dt.dir_hash = ? ORDER BY t.name ASC", f.DirHash)
+		trows, terr := m.db.QueryContext(ctx, "SELECT t.name FROM dir_tag_map dt JOIN tags t ON dt.tag_id = t.id WHERE dt.dir_hash = ? ORDER BY t.name ASC", f.DirHash)
 		if terr == nil {
 			var tags []string
 			for trows.Next() {
@@ -550,6 +878,239 @@ func (m *Mysql) ListFavorites(q string, page int, pageSize int, tags []string) (
 	return list, total, nil
 }
 
+// DeleteFavorites removes favorites by dir hash, cleanupTags also drops their dir_tag_map rows
+func (m *Mysql) DeleteFavorites(ctx context.Context, dirHashes []string, cleanupTags bool) (int64, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	if len(dirHashes) == 0 {
+		return 0, nil
+	}
+	place := strings.TrimSuffix(strings.Repeat("?,", len(dirHashes)), ",")
+	args := toAnySlice(dirHashes)
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.ExecContext(ctx, "DELETE FROM favorites WHERE dir_hash IN ("+place+")", args...)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	if cleanupTags {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM dir_tag_map WHERE dir_hash IN ("+place+")", args...); err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	return n, nil
+}
+
+func (m *Mysql) FavoritesExist(ctx context.Context, dirPaths []string) (map[string]bool, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	out := make(map[string]bool, len(dirPaths))
+	if len(dirPaths) == 0 {
+		return out, nil
+	}
+	byHash := make(map[string]string, len(dirPaths))
+	hashes := make([]string, 0, len(dirPaths))
+	for _, p := range dirPaths {
+		out[p] = false
+		h := DirHash(p)
+		byHash[h] = p
+		hashes = append(hashes, h)
+	}
+	place := strings.TrimSuffix(strings.Repeat("?,", len(hashes)), ",")
+	rows, err := m.db.QueryContext(ctx, "SELECT dir_hash FROM favorites WHERE dir_hash IN ("+place+")", toAnySlice(hashes)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var h string
+		if err := rows.Scan(&h); err != nil {
+			return nil, err
+		}
+		out[byHash[h]] = true
+	}
+	return out, nil
+}
+
+/*
+RelinkFavorites
+Moves favorites from one path to another, or every favorite under a path prefix when prefix is set.
+dir_hash is recomputed and dir_tag_map and album_items rows follow the new hash, all in one transaction.
+Files and directories under the prefix that are not favorites follow too: their file_meta rows,
+per-file tags from dir_tag_map and album items. They are found through file_meta, album_items and
+the local index tables, since dir_tag_map only stores the hash.
+dryRun returns the planned changes without writing.
+*/
+func (m *Mysql) RelinkFavorites(ctx context.Context, from string, to string, prefix bool, dryRun bool) ([]FavoriteRelink, error) {
+	m.EnsureLocalIndexBindingTable(context.WithoutCancel(ctx))
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := tx.QueryContext(ctx, "SELECT dir_path, dir_hash FROM favorites FOR UPDATE")
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	var plan []FavoriteRelink
+	existing := map[string]bool{}
+	for rows.Next() {
+		var p, h string
+		if err := rows.Scan(&p, &h); err != nil {
+			_ = rows.Close()
+			_ = tx.Rollback()
+			return nil, err
+		}
+		existing[h] = true
+		if np, ok := relinkTarget(p, from, to, prefix); ok && np != p {
+			plan = append(plan, FavoriteRelink{Kind: RelinkFavorite, OldPath: p, NewPath: np, OldHash: h, NewHash: DirHash(np)})
+		}
+	}
+	_ = rows.Close()
+	for _, r := range plan {
+		if existing[r.NewHash] {
+			_ = tx.Rollback()
+			return nil, fmt.Errorf("target %s is already a favorite", r.NewPath)
+		}
+	}
+	paths, err := relinkPaths(ctx, tx, from, prefix)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	for _, p := range paths {
+		h := DirHash(p)
+		if existing[h] {
+			continue
+		}
+		if np, ok := relinkTarget(p, from, to, prefix); ok && np != p {
+			plan = append(plan, FavoriteRelink{Kind: RelinkPath, OldPath: p, NewPath: np, OldHash: h, NewHash: DirHash(np)})
+		}
+	}
+	if dryRun || len(plan) == 0 {
+		_ = tx.Rollback()
+		return plan, nil
+	}
+	for _, r := range plan {
+		stmts := []struct {
+			query string
+			args  []interface{}
+		}{
+			{"UPDATE favorites SET dir_path = ?, dir_hash = ? WHERE dir_hash = ?", []interface{}{r.NewPath, r.NewHash, r.OldHash}},
+			{"UPDATE IGNORE dir_tag_map SET dir_hash = ? WHERE dir_hash = ?", []interface{}{r.NewHash, r.OldHash}},
+			{"DELETE FROM dir_tag_map WHERE dir_hash = ?", []interface{}{r.OldHash}},
+			{"UPDATE IGNORE album_items SET item_path = ?, item_hash = ? WHERE item_hash = ?", []interface{}{r.NewPath, r.NewHash, r.OldHash}},
+			{"DELETE FROM album_items WHERE item_hash = ?", []interface{}{r.OldHash}},
+			{"UPDATE IGNORE file_meta SET path = ?, path_hash = ? WHERE path_hash = ?", []interface{}{r.NewPath, r.NewHash, r.OldHash}},
+			{"DELETE FROM file_meta WHERE path_hash = ?", []interface{}{r.OldHash}},
+		}
+		if r.Kind != RelinkFavorite {
+			stmts = stmts[1:]
+		}
+		for _, st := range stmts {
+			if _, err := tx.ExecContext(ctx, st.query, st.args...); err != nil {
+				_ = tx.Rollback()
+				return nil, err
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// relinkPaths the distinct paths equal to from, or under it when prefix is set, that have metadata, album items or index entries
+func relinkPaths(ctx context.Context, tx *sql.Tx, from string, prefix bool) ([]string, error) {
+	cond, args := "= ?", []interface{}{from}
+	if prefix {
+		base := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.TrimRight(from, "/\\"))
+		cond, args = "LIKE ?", []interface{}{base + "%"}
+	}
+	queries := []string{
+		"SELECT path FROM file_meta WHERE path " + cond,
+		"SELECT item_path FROM album_items WHERE item_path " + cond,
+	}
+	trows, err := tx.QueryContext(ctx, "SELECT table_name FROM local_index_bindings")
+	if err != nil {
+		return nil, err
+	}
+	for trows.Next() {
+		var table string
+		if err := trows.Scan(&table); err != nil {
+			_ = trows.Close()
+			return nil, err
+		}
+		if validTableName(table) {
+			queries = append(queries, "SELECT path FROM "+table+" WHERE path "+cond)
+		}
+	}
+	_ = trows.Close()
+
+	seen := map[string]bool{}
+	var out []string
+	for _, q := range queries {
+		rows, err := tx.QueryContext(ctx, q, args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var p string
+			if err := rows.Scan(&p); err != nil {
+				_ = rows.Close()
+				return nil, err
+			}
+			if !seen[p] {
+				seen[p] = true
+				out = append(out, p)
+			}
+		}
+		_ = rows.Close()
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// validTableName local index tables are interpolated into queries, so only [A-Za-z0-9_] is accepted
+func validTableName(table string) bool {
+	for _, ch := range table {
+		if !(ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || ch == '_') {
+			return false
+		}
+	}
+	return table != ""
+}
+
+// relinkTarget returns the new path of p, a prefix only matches whole path segments
+func relinkTarget(p string, from string, to string, prefix bool) (string, bool) {
+	if p == from {
+		return to, true
+	}
+	if !prefix {
+		return "", false
+	}
+	base := strings.TrimRight(from, "/\\")
+	rest := strings.TrimPrefix(p, base)
+	if rest == p || rest == "" || (rest[0] != '/' && rest[0] != '\\') {
+		return "", false
+	}
+	return strings.TrimRight(to, "/\\") + rest, true
+}
+
+// DirHash the key of a directory in favorites, dir_tag_map and album_items
+func DirHash(dirPath string) string {
+	h := sha256.Sum256([]byte(dirPath))
+	return hex.EncodeToString(h[:])
+}
+
 func toAnySlice(ss []string) []interface{} {
 	out := make([]interface{}, len(ss))
 	for i, s := range ss {
@@ -558,33 +1119,54 @@ func toAnySlice(ss []string) []interface{} {
 	return out
 }
 
-func (m *Mysql) EnsureDownloadSaveTable() {
-	_, err := m.db.Exec("CREATE TABLE IF NOT EXISTS downloadsave (" +
-		"  id BIGINT PRIMARY KEY AUTO_INCREMENT," +
-		"  `group` VARCHAR(255)," +
-		"  name VARCHAR(255) NOT NULL," +
-		"  `desc` TEXT," +
-		"  local_address TEXT," +
-		"  UNIQUE KEY uniq_name (name)" +
+func (m *Mysql) EnsureDownloadSaveTable(ctx context.Context) {
+	_, err := m.db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS downloadsave ("+
+		"  id BIGINT PRIMARY KEY AUTO_INCREMENT,"+
+		"  `group` VARCHAR(255),"+
+		"  name VARCHAR(255) NOT NULL,"+
+		"  `desc` TEXT,"+
+		"  local_address TEXT,"+
+		"  `type` VARCHAR(255) DEFAULT NULL,"+
+		"  UNIQUE KEY uniq_name (name),"+
+		"  KEY idx_downloadsave_type (`type`)"+
 		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4")
 	if err != nil {
 		klog.Fatal(err)
 	}
 	// Ensure local_address column exists (for backfill upgrades)
 	var cnt int
-	row := m.db.QueryRow("SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = ? AND table_name = 'downloadsave' AND column_name = 'local_address'", m.dbName)
+	row := m.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = ? AND table_name = 'downloadsave' AND column_name = 'local_address'", m.dbName)
+	_ = row.Scan(&cnt)
+	if cnt == 0 {
+		if _, err := m.db.ExecContext(ctx, "ALTER TABLE downloadsave ADD COLUMN local_address TEXT"); err != nil {
+			klog.Fatal(err)
+		}
+	}
+	// Ensure type column and its index exist (storage relocation)
+	row = m.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = ? AND table_name = 'downloadsave' AND column_name = 'type'", m.dbName)
+	cnt = 0
+	_ = row.Scan(&cnt)
+	if cnt == 0 {
+		if _, err := m.db.ExecContext(ctx, "ALTER TABLE downloadsave ADD COLUMN `type` VARCHAR(255) DEFAULT NULL"); err != nil {
+			klog.Fatal(err)
+		}
+	}
+	row = m.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema = ? AND table_name = 'downloadsave' AND index_name = 'idx_downloadsave_type'", m.dbName)
+	cnt = 0
 	_ = row.Scan(&cnt)
 	if cnt == 0 {
-		if _, err := m.db.Exec("ALTER TABLE downloadsave ADD COLUMN local_address TEXT"); err != nil {
+		if _, err := m.db.ExecContext(ctx, "ALTER TABLE downloadsave ADD KEY idx_downloadsave_type (`type`)"); err != nil {
 			klog.Fatal(err)
 		}
 	}
 }
 
-func (m *Mysql) GetDownloadSaveByName(name string) (*DownloadSave, error) {
-	row := m.db.QueryRow("SELECT id, `group`, name, `desc`, local_address FROM downloadsave WHERE name = ? LIMIT 1", name)
+func (m *Mysql) GetDownloadSaveByName(ctx context.Context, name string) (*DownloadSave, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	row := m.db.QueryRowContext(ctx, "SELECT id, COALESCE(`group`, ''), name, COALESCE(`desc`, ''), COALESCE(local_address, ''), COALESCE(`type`, '') FROM downloadsave WHERE name = ? LIMIT 1", name)
 	var d DownloadSave
-	err := row.Scan(&d.Id, &d.Group, &d.Name, &d.Desc, &d.LocalAddress)
+	err := row.Scan(&d.Id, &d.Group, &d.Name, &d.Desc, &d.LocalAddress, &d.Type)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -594,8 +1176,10 @@ func (m *Mysql) GetDownloadSaveByName(name string) (*DownloadSave, error) {
 	return &d, nil
 }
 
-func (m *Mysql) InsertDownloadSave(name string, group string, desc string, localAddress string) (int64, error) {
-	res, err := m.db.Exec("INSERT INTO downloadsave (`group`, name, `desc`, local_address) VALUES (?, ?, ?, ?)", group, name, desc, localAddress)
+func (m *Mysql) InsertDownloadSave(ctx context.Context, name string, group string, desc string, localAddress string, typ string) (int64, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	res, err := m.db.ExecContext(ctx, "INSERT INTO downloadsave (`group`, name, `desc`, local_address, `type`) VALUES (?, ?, ?, ?, NULLIF(?, ''))", group, name, desc, localAddress, typ)
 	if err != nil {
 		return 0, err
 	}
@@ -603,66 +1187,1127 @@ func (m *Mysql) InsertDownloadSave(name string, group string, desc string, local
 	return id, nil
 }
 
-func (m *Mysql) EnsureAskTable() {
-	_, err := m.db.Exec(`CREATE TABLE IF NOT EXISTS ask_keys (
-  id BIGINT PRIMARY KEY AUTO_INCREMENT,
-  ask VARCHAR(32) UNIQUE NOT NULL,
-  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`)
-	if err != nil {
-		klog.Fatal(err)
+/*
+GetDownloadSavesByNames
+Returns the existing rows keyed by the requested name, queried in chunks of 1000 names.
+The names are joined against downloadsave so the column collation decides equality, a request
+for "Foo" finds a stored "foo" exactly like GetDownloadSaveByName and the unique key do.
+*/
+func (m *Mysql) GetDownloadSavesByNames(ctx context.Context, names []string) (map[string]DownloadSave, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	out := make(map[string]DownloadSave, len(names))
+	const chunk = 1000
+	for start := 0; start < len(names); start += chunk {
+		end := start + chunk
+		if end > len(names) {
+			end = len(names)
+		}
+		part := names[start:end]
+		requested := "SELECT ? AS req" + strings.Repeat(" UNION ALL SELECT ?", len(part)-1)
+		rows, err := m.db.QueryContext(ctx, "SELECT r.req, d.id, COALESCE(d.`group`, ''), d.name, COALESCE(d.`desc`, ''), COALESCE(d.local_address, ''), COALESCE(d.`type`, '') FROM ("+requested+") r JOIN downloadsave d ON d.name = r.req", toAnySlice(part)...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var req string
+			var d DownloadSave
+			if err := rows.Scan(&req, &d.Id, &d.Group, &d.Name, &d.Desc, &d.LocalAddress, &d.Type); err != nil {
+				_ = rows.Close()
+				return nil, err
+			}
+			out[req] = d
+		}
+		_ = rows.Close()
 	}
+	return out, nil
 }
 
-func (m *Mysql) CreateAsk() (*AskKey, error) {
-	m.EnsureAskTable()
-	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	buf := make([]byte, 20)
-	for i := 0; i < 20; i++ {
-		buf[i] = letters[randInt(len(letters))]
-	}
-	ask := string(buf)
-	res, err := m.db.Exec("INSERT INTO ask_keys (ask) VALUES (?)", ask)
+// InsertDownloadSaves inserts all items in one transaction, existing names are reported instead of overwritten
+func (m *Mysql) InsertDownloadSaves(ctx context.Context, items []DownloadSave) ([]DownloadSaveResult, error) {
+	tx, err := m.db.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
-	id, _ := res.LastInsertId()
-	return &AskKey{Id: id, Ask: ask}, nil
-}
-
-func (m *Mysql) ListAsk() ([]AskKey, error) {
-	rows, err := m.db.Query("SELECT id, ask FROM ask_keys ORDER BY id ASC")
+	stmt, err := tx.PrepareContext(ctx, "INSERT IGNORE INTO downloadsave (`group`, name, `desc`, local_address, `type`) VALUES (?, ?, ?, ?, NULLIF(?, ''))")
 	if err != nil {
+		_ = tx.Rollback()
 		return nil, err
 	}
-	defer rows.Close()
-	var list []AskKey
-	for rows.Next() {
-		var a AskKey
-		if err := rows.Scan(&a.Id, &a.Ask); err != nil {
-			return nil, err
+	results := make([]DownloadSaveResult, 0, len(items))
+	for _, it := range items {
+		r := DownloadSaveResult{Name: it.Name}
+		res, err := stmt.ExecContext(ctx, it.Group, it.Name, it.Desc, it.LocalAddress, it.Type)
+		if err != nil {
+			r.Status = "failed"
+			r.Error = err.Error()
+		} else if n, _ := res.RowsAffected(); n == 0 {
+			r.Status = "exists"
+		} else {
+			r.Status = "created"
+			r.Id, _ = res.LastInsertId()
 		}
-		list = append(list, a)
+		results = append(results, r)
 	}
-	return list, nil
+	_ = stmt.Close()
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return results, nil
 }
 
-func (m *Mysql) CheckAsk(token string) (bool, error) {
-	row := m.db.QueryRow("SELECT COUNT(*) FROM ask_keys WHERE ask = ? LIMIT 1", token)
+func (m *Mysql) ListDownloadSaves(ctx context.Context, q string, group string, page int, pageSize int) ([]DownloadSave, int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	if page <= 0 {
+		page = 1
+	}
+	if pageSize <= 0 || pageSize > 200 {
+		pageSize = 20
+	}
+	offset := (page - 1) * pageSize
+	where := "1=1"
+	args := []interface{}{}
+	if q != "" {
+		where += " AND (name LIKE ? OR `group` LIKE ? OR `desc` LIKE ? OR local_address LIKE ?)"
+		pat := "%" + q + "%"
+		args = append(args, pat, pat, pat, pat)
+	}
+	if group != "" {
+		where += " AND `group` = ?"
+		args = append(args, group)
+	}
+	var total int
+	row := m.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM downloadsave WHERE "+where, args...)
+	if err := row.Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	query := "SELECT id, COALESCE(`group`, ''), name, COALESCE(`desc`, ''), COALESCE(local_address, ''), COALESCE(`type`, '') FROM downloadsave WHERE " + where + " ORDER BY id DESC LIMIT ? OFFSET ?"
+	rows, err := m.db.QueryContext(ctx, query, append(args, pageSize, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var list []DownloadSave
+	for rows.Next() {
+		var d DownloadSave
+		if err := rows.Scan(&d.Id, &d.Group, &d.Name, &d.Desc, &d.LocalAddress, &d.Type); err != nil {
+			return nil, 0, err
+		}
+		list = append(list, d)
+	}
+	return list, total, nil
+}
+
+func (m *Mysql) GetDownloadSave(ctx context.Context, id int64) (*DownloadSave, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	row := m.db.QueryRowContext(ctx, "SELECT id, COALESCE(`group`, ''), name, COALESCE(`desc`, ''), COALESCE(local_address, ''), COALESCE(`type`, '') FROM downloadsave WHERE id = ? LIMIT 1", id)
+	var d DownloadSave
+	err := row.Scan(&d.Id, &d.Group, &d.Name, &d.Desc, &d.LocalAddress, &d.Type)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (m *Mysql) UpdateDownloadSave(ctx context.Context, id int64, group string, desc string, localAddress string, typ string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	_, err := m.db.ExecContext(ctx, "UPDATE downloadsave SET `group` = ?, `desc` = ?, local_address = ?, `type` = NULLIF(?, '') WHERE id = ?", group, desc, localAddress, typ, id)
+	return err
+}
+
+// ListDownloadSavesAfter pages through downloadsave by id, stable while rows are being inserted
+func (m *Mysql) ListDownloadSavesAfter(ctx context.Context, afterID int64, limit int) ([]DownloadSave, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	if limit <= 0 {
+		limit = 500
+	}
+	rows, err := m.db.QueryContext(ctx, "SELECT id, COALESCE(`group`, ''), name, COALESCE(`desc`, ''), COALESCE(local_address, ''), COALESCE(`type`, '') FROM downloadsave WHERE id > ? ORDER BY id ASC LIMIT ?", afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []DownloadSave
+	for rows.Next() {
+		var d DownloadSave
+		if err := rows.Scan(&d.Id, &d.Group, &d.Name, &d.Desc, &d.LocalAddress, &d.Type); err != nil {
+			return nil, err
+		}
+		list = append(list, d)
+	}
+	return list, nil
+}
+
+func (m *Mysql) EnsureDownloadSaveCheckTable(ctx context.Context) {
+	_, err := m.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS downloadsave_check (
+  download_id BIGINT PRIMARY KEY,
+  status VARCHAR(16) NOT NULL,
+  size BIGINT NOT NULL DEFAULT 0,
+  error TEXT,
+  checked_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  INDEX idx_status (status)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`)
+	if err != nil {
+		klog.Fatal(err)
+	}
+}
+
+func (m *Mysql) SaveDownloadSaveChecks(ctx context.Context, checks []DownloadSaveCheck) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO downloadsave_check (download_id, status, size, error, checked_at) VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
+ON DUPLICATE KEY UPDATE status = VALUES(status), size = VALUES(size), error = VALUES(error), checked_at = VALUES(checked_at)`)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	for _, ch := range checks {
+		if _, err := stmt.ExecContext(ctx, ch.DownloadId, ch.Status, ch.Size, ch.Error); err != nil {
+			_ = stmt.Close()
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	_ = stmt.Close()
+	return tx.Commit()
+}
+
+// ListDownloadSaveChecks joins the last check with its downloadsave row, rows of deleted downloads are skipped
+func (m *Mysql) ListDownloadSaveChecks(ctx context.Context, status string, page int, pageSize int) ([]DownloadSaveCheck, int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	if page <= 0 {
+		page = 1
+	}
+	if pageSize <= 0 || pageSize > 200 {
+		pageSize = 20
+	}
+	offset := (page - 1) * pageSize
+	where := "1=1"
+	args := []interface{}{}
+	if status != "" {
+		where += " AND c.status = ?"
+		args = append(args, status)
+	}
+	from := "downloadsave_check c JOIN downloadsave d ON d.id = c.download_id"
+	var total int
+	row := m.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+from+" WHERE "+where, args...)
+	if err := row.Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	query := "SELECT c.download_id, d.name, COALESCE(d.local_address, ''), c.status, c.size, COALESCE(c.error, ''), DATE_FORMAT(c.checked_at, '%Y-%m-%d %H:%i:%s') FROM " + from + " WHERE " + where + " ORDER BY c.download_id ASC LIMIT ? OFFSET ?"
+	rows, err := m.db.QueryContext(ctx, query, append(args, pageSize, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var list []DownloadSaveCheck
+	for rows.Next() {
+		var ch DownloadSaveCheck
+		if err := rows.Scan(&ch.DownloadId, &ch.Name, &ch.LocalAddress, &ch.Status, &ch.Size, &ch.Error, &ch.CheckedAt); err != nil {
+			return nil, 0, err
+		}
+		list = append(list, ch)
+	}
+	return list, total, nil
+}
+
+func (m *Mysql) CountDownloadSaveChecks(ctx context.Context) (map[string]int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, "SELECT c.status, COUNT(*) FROM downloadsave_check c JOIN downloadsave d ON d.id = c.download_id GROUP BY c.status")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := map[string]int{}
+	for rows.Next() {
+		var st string
+		var n int
+		if err := rows.Scan(&st, &n); err != nil {
+			return nil, err
+		}
+		out[st] = n
+	}
+	return out, nil
+}
+
+/*
+RelocateDownloadSaves
+Rewrites the local_address prefix of every row of the given type, a prefix only matches whole path segments.
+newType, when set, replaces the type of the relocated rows. dryRun returns the planned changes without writing.
+*/
+func (m *Mysql) RelocateDownloadSaves(ctx context.Context, typ string, from string, to string, newType string, dryRun bool) ([]DownloadSaveRelocation, error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := tx.QueryContext(ctx, "SELECT id, name, COALESCE(local_address, '') FROM downloadsave WHERE `type` = ? FOR UPDATE", typ)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	var plan []DownloadSaveRelocation
+	for rows.Next() {
+		var r DownloadSaveRelocation
+		if err := rows.Scan(&r.Id, &r.Name, &r.OldAddress); err != nil {
+			_ = rows.Close()
+			_ = tx.Rollback()
+			return nil, err
+		}
+		if np, ok := relinkTarget(r.OldAddress, from, to, true); ok {
+			r.NewAddress = np
+			plan = append(plan, r)
+		}
+	}
+	_ = rows.Close()
+	if dryRun || len(plan) == 0 {
+		_ = tx.Rollback()
+		return plan, nil
+	}
+	if newType == "" {
+		newType = typ
+	}
+	stmt, err := tx.PrepareContext(ctx, "UPDATE downloadsave SET local_address = ?, `type` = ? WHERE id = ?")
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	for _, r := range plan {
+		if _, err := stmt.ExecContext(ctx, r.NewAddress, newType, r.Id); err != nil {
+			_ = stmt.Close()
+			_ = tx.Rollback()
+			return nil, err
+		}
+	}
+	_ = stmt.Close()
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+func (m *Mysql) DeleteDownloadSave(ctx context.Context, id int64) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	_, err := m.db.ExecContext(ctx, "DELETE FROM downloadsave WHERE id = ?", id)
+	return err
+}
+
+func (m *Mysql) ListDownloadSaveGroups(ctx context.Context) ([]DownloadSaveGroup, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, "SELECT COALESCE(`group`, ''), COUNT(*) FROM downloadsave GROUP BY COALESCE(`group`, '') ORDER BY COALESCE(`group`, '') ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []DownloadSaveGroup
+	for rows.Next() {
+		var g DownloadSaveGroup
+		if err := rows.Scan(&g.Group, &g.Count); err != nil {
+			return nil, err
+		}
+		list = append(list, g)
+	}
+	return list, nil
+}
+
+func (m *Mysql) EnsureAskTable(ctx context.Context) {
+	_, err := m.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS ask_keys (
+  id BIGINT PRIMARY KEY AUTO_INCREMENT,
+  ask_hash CHAR(64) UNIQUE NOT NULL,
+  ask_prefix VARCHAR(16) NOT NULL DEFAULT '',
+  name VARCHAR(255) NOT NULL DEFAULT '',
+  scopes VARCHAR(255) NOT NULL DEFAULT '',
+  expires_at TIMESTAMP NULL DEFAULT NULL,
+  last_used_at TIMESTAMP NULL DEFAULT NULL,
+  use_count BIGINT NOT NULL DEFAULT 0,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`)
+	if err != nil {
+		klog.Fatal(err)
+	}
+	// Ensure label, scope, expiry, usage and hash columns exist (upgrades from plain keys)
+	columns := []struct {
+		name string
+		ddl  string
+	}{
+		{"name", "ALTER TABLE ask_keys ADD COLUMN name VARCHAR(255) NOT NULL DEFAULT ''"},
+		{"scopes", "ALTER TABLE ask_keys ADD COLUMN scopes VARCHAR(255) NOT NULL DEFAULT ''"},
+		{"expires_at", "ALTER TABLE ask_keys ADD COLUMN expires_at TIMESTAMP NULL DEFAULT NULL"},
+		{"last_used_at", "ALTER TABLE ask_keys ADD COLUMN last_used_at TIMESTAMP NULL DEFAULT NULL"},
+		{"use_count", "ALTER TABLE ask_keys ADD COLUMN use_count BIGINT NOT NULL DEFAULT 0"},
+		{"ask_hash", "ALTER TABLE ask_keys ADD COLUMN ask_hash CHAR(64) NULL, ADD UNIQUE KEY uniq_ask_hash (ask_hash)"},
+		{"ask_prefix", "ALTER TABLE ask_keys ADD COLUMN ask_prefix VARCHAR(16) NOT NULL DEFAULT ''"},
+	}
+	for _, col := range columns {
+		if !m.askColumnExists(ctx, col.name) {
+			if _, err := m.db.ExecContext(ctx, col.ddl); err != nil {
+				klog.Fatal(err)
+			}
+		}
+	}
+	// Hash plaintext keys of older versions and drop the plaintext column,
+	// existing keys keep working since CheckAsk compares the SHA-256 digest
+	if m.askColumnExists(ctx, "ask") {
+		if _, err := m.db.ExecContext(ctx, "UPDATE ask_keys SET ask_hash = SHA2(ask, 256), ask_prefix = LEFT(ask, ?) WHERE ask_hash IS NULL", legacyAskDisplayPrefixLen); err != nil {
+			klog.Fatal(err)
+		}
+		if _, err := m.db.ExecContext(ctx, "ALTER TABLE ask_keys DROP COLUMN ask"); err != nil {
+			klog.Fatal(err)
+		}
+		klog.Info("ask_keys migrated to hashed keys")
+	}
+	// Earlier migrations kept 8 characters of unprefixed keys, shorten them to the legacy length
+	if _, err := m.db.ExecContext(ctx, "UPDATE ask_keys SET ask_prefix = LEFT(ask_prefix, ?) WHERE ask_prefix NOT LIKE 'lpt\\_%' AND CHAR_LENGTH(ask_prefix) > ?", legacyAskDisplayPrefixLen, legacyAskDisplayPrefixLen); err != nil {
+		klog.Fatal(err)
+	}
+	// ask_hash was added as NULL for the backfill, rows without a hash can never authenticate
+	var nullable string
+	row := m.db.QueryRowContext(ctx, "SELECT is_nullable FROM information_schema.columns WHERE table_schema = ? AND table_name = 'ask_keys' AND column_name = 'ask_hash'", m.dbName)
+	if err := row.Scan(&nullable); err == nil && nullable == "YES" {
+		if _, err := m.db.ExecContext(ctx, "DELETE FROM ask_keys WHERE ask_hash IS NULL"); err != nil {
+			klog.Fatal(err)
+		}
+		if _, err := m.db.ExecContext(ctx, "ALTER TABLE ask_keys MODIFY ask_hash CHAR(64) NOT NULL"); err != nil {
+			klog.Fatal(err)
+		}
+	}
+}
+
+func (m *Mysql) askColumnExists(ctx context.Context, column string) bool {
+	var cnt int
+	row := m.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = ? AND table_name = 'ask_keys' AND column_name = ?", m.dbName, column)
+	_ = row.Scan(&cnt)
+	return cnt > 0
+}
+
+const (
+	// askKeyPrefix makes ask keys recognizable in configs and secret scanners
+	askKeyPrefix        = "lpt_"
+	askKeyRandomLen     = 32
+	askDisplayPrefixLen = 8
+	// legacyAskDisplayPrefixLen unprefixed keys of older versions only have 20 secret characters
+	legacyAskDisplayPrefixLen = 4
+)
+
+// AskDisplayPrefix the part of a key that may be stored and shown, "lpt_" plus 4 characters
+// for current keys and only 4 characters of the shorter unprefixed legacy keys
+func AskDisplayPrefix(ask string) string {
+	n := legacyAskDisplayPrefixLen
+	if strings.HasPrefix(ask, askKeyPrefix) {
+		n = askDisplayPrefixLen
+	}
+	if len(ask) < n {
+		return ask
+	}
+	return ask[:n]
+}
+
+// newAskSecret returns a prefixed key of uniformly distributed base62 characters
+func newAskSecret() (string, error) {
+	return newSecret(askKeyPrefix)
+}
+
+func newSecret(prefix string) (string, error) {
+	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	// bytes >= 248 are rejected so every letter has the same probability (248 = 4*62)
+	const limit = 256 - 256%len(letters)
+	out := make([]byte, 0, askKeyRandomLen)
+	buf := make([]byte, askKeyRandomLen)
+	for len(out) < askKeyRandomLen {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		for _, b := range buf {
+			if int(b) >= limit {
+				continue
+			}
+			out = append(out, letters[int(b)%len(letters)])
+			if len(out) == askKeyRandomLen {
+				break
+			}
+		}
+	}
+	return prefix + string(out), nil
+}
+
+// secretHash SHA-256 digest stored instead of ask keys and API tokens
+func secretHash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func (m *Mysql) CreateAsk(ctx context.Context, name string, scopes []string, ttl time.Duration) (*AskKey, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	m.EnsureAskTable(context.WithoutCancel(ctx))
+	ask, err := newAskSecret()
+	if err != nil {
+		return nil, err
+	}
+	var ttlSeconds interface{}
+	if ttl > 0 {
+		ttlSeconds = int64(ttl / time.Second)
+	}
+	res, err := m.db.ExecContext(ctx, "INSERT INTO ask_keys (ask_hash, ask_prefix, name, scopes, expires_at) VALUES (?, ?, ?, ?, IF(? IS NULL, NULL, DATE_ADD(CURRENT_TIMESTAMP, INTERVAL ? SECOND)))", secretHash(ask), AskDisplayPrefix(ask), name, strings.Join(scopes, ","), ttlSeconds, ttlSeconds)
+	if err != nil {
+		return nil, err
+	}
+	id, _ := res.LastInsertId()
+	key, err := m.getAsk(ctx, m.db, id)
+	if err != nil {
+		return nil, err
+	}
+	// the plaintext key is only returned once, at creation
+	key.Ask = ask
+	return key, nil
+}
+
+const askColumns = "id, ask_prefix, name, scopes, COALESCE(DATE_FORMAT(expires_at, '%Y-%m-%d %H:%i:%s'), ''), COALESCE(DATE_FORMAT(last_used_at, '%Y-%m-%d %H:%i:%s'), ''), use_count, DATE_FORMAT(created_at, '%Y-%m-%d %H:%i:%s')"
+
+func scanAsk(row interface{ Scan(dest ...any) error }) (AskKey, error) {
+	var a AskKey
+	var scopes string
+	if err := row.Scan(&a.Id, &a.Prefix, &a.Name, &scopes, &a.ExpiresAt, &a.LastUsedAt, &a.UseCount, &a.CreatedAt); err != nil {
+		return a, err
+	}
+	a.Scopes = splitList(scopes)
+	return a, nil
+}
+
+func (m *Mysql) getAsk(ctx context.Context, q interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}, id int64) (*AskKey, error) {
+	a, err := scanAsk(q.QueryRowContext(ctx, "SELECT "+askColumns+" FROM ask_keys WHERE id = ?", id))
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func (m *Mysql) ListAsk(ctx context.Context) ([]AskKey, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, "SELECT "+askColumns+" FROM ask_keys ORDER BY id ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []AskKey
+	for rows.Next() {
+		a, err := scanAsk(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, a)
+	}
+	return list, nil
+}
+
+// CheckAsk looks the key up by its SHA-256 digest, accepting an unexpired key whose scopes are empty or contain scope, and records the use
+func (m *Mysql) CheckAsk(ctx context.Context, token string, scope string) (bool, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	row := m.db.QueryRowContext(ctx, "SELECT id, scopes FROM ask_keys WHERE ask_hash = ? AND (expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP) LIMIT 1", secretHash(token))
+	var id int64
+	var scopes string
+	if err := row.Scan(&id, &scopes); err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+	if allowed := splitList(scopes); len(allowed) > 0 {
+		found := false
+		for _, s := range allowed {
+			if s == scope {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false, nil
+		}
+	}
+	if _, err := m.db.ExecContext(ctx, "UPDATE ask_keys SET last_used_at = CURRENT_TIMESTAMP, use_count = use_count + 1 WHERE id = ?", id); err != nil {
+		klog.Warningf("update ask usage failed: %v", err)
+	}
+	return true, nil
+}
+
+/*
+RotateAsk
+Issues a new key with the same name, scopes and expiry, the old key stays valid
+for the grace period (or until its own expiry when that comes first).
+*/
+func (m *Mysql) RotateAsk(ctx context.Context, id int64, grace time.Duration) (*AskKey, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	var cnt int
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM ask_keys WHERE id = ? FOR UPDATE", id).Scan(&cnt); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	if cnt == 0 {
+		_ = tx.Rollback()
+		return nil, nil
+	}
+	ask, err := newAskSecret()
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	res, err := tx.ExecContext(ctx, "INSERT INTO ask_keys (ask_hash, ask_prefix, name, scopes, expires_at) SELECT ?, ?, name, scopes, expires_at FROM ask_keys WHERE id = ?", secretHash(ask), AskDisplayPrefix(ask), id)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	newID, _ := res.LastInsertId()
+	graceSeconds := int64(grace / time.Second)
+	if _, err := tx.ExecContext(ctx, "UPDATE ask_keys SET expires_at = IF(expires_at IS NULL OR expires_at > DATE_ADD(CURRENT_TIMESTAMP, INTERVAL ? SECOND), DATE_ADD(CURRENT_TIMESTAMP, INTERVAL ? SECOND), expires_at) WHERE id = ?", graceSeconds, graceSeconds, id); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	key, err := m.getAsk(ctx, tx, newID)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	key.Ask = ask
+	return key, nil
+}
+
+func (m *Mysql) DeleteAsk(ctx context.Context, id int64) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	_, err := m.db.ExecContext(ctx, "DELETE FROM ask_keys WHERE id = ?", id)
+	return err
+}
+
+func (m *Mysql) EnsureAlbumsTables(ctx context.Context) {
+	_, err := m.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS albums (
+  id BIGINT PRIMARY KEY AUTO_INCREMENT,
+  name VARCHAR(255) NOT NULL,
+  description TEXT,
+  cover_path TEXT,
+  position INT NOT NULL DEFAULT 0,
+  owner_id BIGINT NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`)
+	if err != nil {
+		klog.Fatal(err)
+	}
+	// Ensure albums.owner_id exists (albums created before users had owners stay unowned)
 	var cnt int
-	if err := row.Scan(&cnt); err != nil {
-		return false, err
+	row := m.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = ? AND table_name = 'albums' AND column_name = 'owner_id'", m.dbName)
+	_ = row.Scan(&cnt)
+	if cnt == 0 {
+		if _, err := m.db.ExecContext(ctx, "ALTER TABLE albums ADD COLUMN owner_id BIGINT NULL"); err != nil {
+			klog.Fatal(err)
+		}
+	}
+	_, err = m.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS album_items (
+  id BIGINT PRIMARY KEY AUTO_INCREMENT,
+  album_id BIGINT NOT NULL,
+  item_type VARCHAR(16) NOT NULL,
+  item_path TEXT NOT NULL,
+  item_hash CHAR(64) NOT NULL,
+  position INT NOT NULL DEFAULT 0,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE KEY uniq_album_item (album_id, item_hash),
+  INDEX idx_album_position (album_id, position)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`)
+	if err != nil {
+		klog.Fatal(err)
+	}
+}
+
+// ListAlbums ownerID greater than zero only returns the albums of that user
+func (m *Mysql) ListAlbums(ctx context.Context, ownerID int64) ([]Album, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	where := "1=1"
+	args := []interface{}{}
+	if ownerID > 0 {
+		where = "a.owner_id = ?"
+		args = append(args, ownerID)
+	}
+	rows, err := m.db.QueryContext(ctx, `SELECT a.id, a.name, COALESCE(a.description, ''), COALESCE(a.cover_path, ''), a.position,
+  (SELECT COUNT(*) FROM album_items i WHERE i.album_id = a.id), DATE_FORMAT(a.created_at, '%Y-%m-%d %H:%i:%s'), COALESCE(a.owner_id, 0)
+FROM albums a WHERE `+where+` ORDER BY a.position ASC, a.id ASC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []Album
+	for rows.Next() {
+		var a Album
+		if err := rows.Scan(&a.Id, &a.Name, &a.Description, &a.CoverPath, &a.Position, &a.ItemCount, &a.CreatedAt, &a.OwnerId); err != nil {
+			return nil, err
+		}
+		list = append(list, a)
+	}
+	return list, nil
+}
+
+func (m *Mysql) GetAlbum(ctx context.Context, id int64) (*Album, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	row := m.db.QueryRowContext(ctx, `SELECT a.id, a.name, COALESCE(a.description, ''), COALESCE(a.cover_path, ''), a.position,
+  (SELECT COUNT(*) FROM album_items i WHERE i.album_id = a.id), DATE_FORMAT(a.created_at, '%Y-%m-%d %H:%i:%s'), COALESCE(a.owner_id, 0)
+FROM albums a WHERE a.id = ? LIMIT 1`, id)
+	var a Album
+	err := row.Scan(&a.Id, &a.Name, &a.Description, &a.CoverPath, &a.Position, &a.ItemCount, &a.CreatedAt, &a.OwnerId)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func (m *Mysql) CreateAlbum(ctx context.Context, name string, description string, coverPath string, ownerID int64) (int64, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	res, err := m.db.ExecContext(ctx, `INSERT INTO albums (name, description, cover_path, position, owner_id)
+SELECT ?, ?, ?, COALESCE(MAX(position), 0) + 1, NULLIF(?, 0) FROM albums`, name, description, coverPath, ownerID)
+	if err != nil {
+		return 0, err
+	}
+	id, _ := res.LastInsertId()
+	return id, nil
+}
+
+func (m *Mysql) UpdateAlbum(ctx context.Context, id int64, name string, description string, coverPath string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	_, err := m.db.ExecContext(ctx, "UPDATE albums SET name = ?, description = ?, cover_path = ? WHERE id = ?", name, description, coverPath, id)
+	return err
+}
+
+func (m *Mysql) DeleteAlbum(ctx context.Context, id int64) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM album_items WHERE album_id = ?", id); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM albums WHERE id = ?", id); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// ReorderAlbums sets the position of every given album to its index in ids
+func (m *Mysql) ReorderAlbums(ctx context.Context, ids []int64) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for i, id := range ids {
+		if _, err := tx.ExecContext(ctx, "UPDATE albums SET position = ? WHERE id = ?", i+1, id); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (m *Mysql) ListAlbumItems(ctx context.Context, albumID int64) ([]AlbumItem, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, "SELECT id, album_id, item_type, item_path, item_hash, position, DATE_FORMAT(created_at, '%Y-%m-%d %H:%i:%s') FROM album_items WHERE album_id = ? ORDER BY position ASC, id ASC", albumID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []AlbumItem
+	for rows.Next() {
+		var it AlbumItem
+		if err := rows.Scan(&it.Id, &it.AlbumId, &it.ItemType, &it.Path, &it.Hash, &it.Position, &it.CreatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, it)
+	}
+	return list, nil
+}
+
+// AddAlbumItems appends items after the current last position, items already in the album are skipped
+func (m *Mysql) AddAlbumItems(ctx context.Context, albumID int64, items []AlbumItem) (int64, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	var pos int
+	row := tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(position), 0) FROM album_items WHERE album_id = ?", albumID)
+	if err := row.Scan(&pos); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	var added int64
+	for _, it := range items {
+		pos++
+		res, err := tx.ExecContext(ctx, "INSERT IGNORE INTO album_items (album_id, item_type, item_path, item_hash, position) VALUES (?, ?, ?, ?, ?)",
+			albumID, it.ItemType, it.Path, DirHash(it.Path), pos)
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+		n, _ := res.RowsAffected()
+		added += n
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return added, nil
+}
+
+func (m *Mysql) RemoveAlbumItems(ctx context.Context, albumID int64, itemIDs []int64) (int64, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	if len(itemIDs) == 0 {
+		return 0, nil
+	}
+	place := strings.TrimSuffix(strings.Repeat("?,", len(itemIDs)), ",")
+	args := []interface{}{albumID}
+	for _, id := range itemIDs {
+		args = append(args, id)
+	}
+	res, err := m.db.ExecContext(ctx, "DELETE FROM album_items WHERE album_id = ? AND id IN ("+place+")", args...)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	return n, nil
+}
+
+// ReorderAlbumItems sets the position of every given item to its index in itemIDs
+func (m *Mysql) ReorderAlbumItems(ctx context.Context, albumID int64, itemIDs []int64) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for i, id := range itemIDs {
+		if _, err := tx.ExecContext(ctx, "UPDATE album_items SET position = ? WHERE album_id = ? AND id = ?", i+1, albumID, id); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (m *Mysql) EnsureAutoTagRulesTable(ctx context.Context) {
+	_, err := m.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS autotag_rules (
+  id BIGINT PRIMARY KEY AUTO_INCREMENT,
+  name VARCHAR(255) NOT NULL,
+  tags TEXT NOT NULL,
+  path_glob VARCHAR(1024) DEFAULT '',
+  path_regex VARCHAR(1024) DEFAULT '',
+  extensions VARCHAR(255) DEFAULT '',
+  camera VARCHAR(255) DEFAULT '',
+  date_from VARCHAR(10) DEFAULT '',
+  date_to VARCHAR(10) DEFAULT '',
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`)
+	if err != nil {
+		klog.Fatal(err)
+	}
+}
+
+func (m *Mysql) ListAutoTagRules(ctx context.Context) ([]AutoTagRule, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, "SELECT id, name, tags, path_glob, path_regex, extensions, camera, date_from, date_to FROM autotag_rules ORDER BY id ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []AutoTagRule
+	for rows.Next() {
+		var r AutoTagRule
+		var tags, exts string
+		if err := rows.Scan(&r.Id, &r.Name, &tags, &r.PathGlob, &r.PathRegex, &exts, &r.Camera, &r.DateFrom, &r.DateTo); err != nil {
+			return nil, err
+		}
+		r.Tags = splitList(tags)
+		r.Extensions = splitList(exts)
+		r.Source = "database"
+		list = append(list, r)
+	}
+	return list, nil
+}
+
+func (m *Mysql) AddAutoTagRule(ctx context.Context, rule AutoTagRule) (int64, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	res, err := m.db.ExecContext(ctx, "INSERT INTO autotag_rules (name, tags, path_glob, path_regex, extensions, camera, date_from, date_to) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		rule.Name, strings.Join(rule.Tags, ","), rule.PathGlob, rule.PathRegex, strings.Join(rule.Extensions, ","), rule.Camera, rule.DateFrom, rule.DateTo)
+	if err != nil {
+		return 0, err
+	}
+	id, _ := res.LastInsertId()
+	return id, nil
+}
+
+func (m *Mysql) DeleteAutoTagRule(ctx context.Context, id int64) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	_, err := m.db.ExecContext(ctx, "DELETE FROM autotag_rules WHERE id = ?", id)
+	return err
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			out = append(out, v)
+		}
 	}
-	return cnt > 0, nil
+	return out
 }
 
-func randInt(n int) int {
-	b := make([]byte, 1)
-	_, _ = rand.Read(b)
-	return int(b[0]) % n
+func (m *Mysql) EnsureAuditLogTable(ctx context.Context) {
+	_, err := m.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS audit_log (
+  id BIGINT PRIMARY KEY AUTO_INCREMENT,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  user_id BIGINT NOT NULL DEFAULT 0,
+  actor VARCHAR(255) NOT NULL DEFAULT '',
+  ip VARCHAR(64) NOT NULL DEFAULT '',
+  method VARCHAR(16) NOT NULL,
+  route VARCHAR(255) NOT NULL,
+  target VARCHAR(1024) NOT NULL DEFAULT '',
+  status INT NOT NULL,
+  INDEX idx_audit_created (created_at),
+  INDEX idx_audit_actor (actor)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`)
+	if err != nil {
+		klog.Fatal(err)
+	}
 }
 
-func (m *Mysql) DeleteAsk(id int64) error {
-	_, err := m.db.Exec("DELETE FROM ask_keys WHERE id = ?", id)
+func (m *Mysql) InsertAuditLog(ctx context.Context, entry AuditLog) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	_, err := m.db.ExecContext(ctx, "INSERT INTO audit_log (user_id, actor, ip, method, route, target, status) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		entry.UserId, entry.Actor, entry.IP, entry.Method, entry.Route, entry.Target, entry.Status)
 	return err
 }
+
+// ListAuditLogs newest first
+func (m *Mysql) ListAuditLogs(ctx context.Context, filter AuditLogFilter, page int, pageSize int) ([]AuditLog, int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	if page <= 0 {
+		page = 1
+	}
+	if pageSize <= 0 || pageSize > 200 {
+		pageSize = 50
+	}
+	offset := (page - 1) * pageSize
+	where := "1=1"
+	args := []interface{}{}
+	if filter.Actor != "" {
+		where += " AND actor = ?"
+		args = append(args, filter.Actor)
+	}
+	if filter.Route != "" {
+		where += " AND route LIKE ?"
+		args = append(args, filter.Route+"%")
+	}
+	if filter.Method != "" {
+		where += " AND method = ?"
+		args = append(args, strings.ToUpper(filter.Method))
+	}
+	switch filter.Result {
+	case "ok":
+		where += " AND status < 400"
+	case "error":
+		where += " AND status >= 400"
+	}
+	if filter.From != "" {
+		where += " AND created_at >= ?"
+		args = append(args, filter.From)
+	}
+	if filter.To != "" {
+		where += " AND created_at < DATE_ADD(?, INTERVAL 1 DAY)"
+		args = append(args, filter.To)
+	}
+	var total int
+	if err := m.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM audit_log WHERE "+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := m.db.QueryContext(ctx, "SELECT id, DATE_FORMAT(created_at, '%Y-%m-%d %H:%i:%s'), user_id, actor, ip, method, route, target, status FROM audit_log WHERE "+where+" ORDER BY id DESC LIMIT ? OFFSET ?", append(args, pageSize, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var list []AuditLog
+	for rows.Next() {
+		var a AuditLog
+		if err := rows.Scan(&a.Id, &a.CreatedAt, &a.UserId, &a.Actor, &a.IP, &a.Method, &a.Route, &a.Target, &a.Status); err != nil {
+			return nil, 0, err
+		}
+		list = append(list, a)
+	}
+	return list, total, nil
+}
+
+func (m *Mysql) PurgeAuditLogs(ctx context.Context, olderThan time.Duration) (int64, error) {
+	res, err := m.db.ExecContext(ctx, "DELETE FROM audit_log WHERE created_at < DATE_SUB(CURRENT_TIMESTAMP, INTERVAL ? SECOND)", int64(olderThan/time.Second))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// apiTokenPrefix distinguishes personal access tokens from ask keys
+const apiTokenPrefix = "lpt_pat_"
+
+func (m *Mysql) EnsureAPITokensTable(ctx context.Context) {
+	_, err := m.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS api_tokens (
+  id BIGINT PRIMARY KEY AUTO_INCREMENT,
+  user_id BIGINT NOT NULL,
+  name VARCHAR(255) NOT NULL DEFAULT '',
+  token_hash CHAR(64) UNIQUE NOT NULL,
+  token_prefix VARCHAR(16) NOT NULL DEFAULT '',
+  expires_at TIMESTAMP NULL DEFAULT NULL,
+  last_used_at TIMESTAMP NULL DEFAULT NULL,
+  revoked_at TIMESTAMP NULL DEFAULT NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  INDEX idx_api_tokens_user (user_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`)
+	if err != nil {
+		klog.Fatal(err)
+	}
+}
+
+const apiTokenColumns = "t.id, t.user_id, u.username, u.role, u.disabled, t.name, t.token_prefix, COALESCE(DATE_FORMAT(t.expires_at, '%Y-%m-%d %H:%i:%s'), ''), COALESCE(DATE_FORMAT(t.last_used_at, '%Y-%m-%d %H:%i:%s'), ''), COALESCE(DATE_FORMAT(t.revoked_at, '%Y-%m-%d %H:%i:%s'), ''), DATE_FORMAT(t.created_at, '%Y-%m-%d %H:%i:%s')"
+
+func scanAPIToken(row interface{ Scan(dest ...any) error }) (*APIToken, error) {
+	var t APIToken
+	err := row.Scan(&t.Id, &t.UserId, &t.Username, &t.Role, &t.Disabled, &t.Name, &t.Prefix, &t.ExpiresAt, &t.LastUsedAt, &t.RevokedAt, &t.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// CreateAPIToken ttl of zero creates a token that never expires
+func (m *Mysql) CreateAPIToken(ctx context.Context, userID int64, name string, ttl time.Duration) (*APIToken, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	token, err := newSecret(apiTokenPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var ttlSeconds interface{}
+	if ttl > 0 {
+		ttlSeconds = int64(ttl / time.Second)
+	}
+	res, err := m.db.ExecContext(ctx, "INSERT INTO api_tokens (user_id, name, token_hash, token_prefix, expires_at) VALUES (?, ?, ?, ?, IF(? IS NULL, NULL, DATE_ADD(CURRENT_TIMESTAMP, INTERVAL ? SECOND)))",
+		userID, name, secretHash(token), token[:len(apiTokenPrefix)+4], ttlSeconds, ttlSeconds)
+	if err != nil {
+		return nil, err
+	}
+	id, _ := res.LastInsertId()
+	t, err := scanAPIToken(m.db.QueryRowContext(ctx, "SELECT "+apiTokenColumns+" FROM api_tokens t JOIN userlogin u ON u.id = t.user_id WHERE t.id = ?", id))
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
+		return nil, fmt.Errorf("token %d not found after insert", id)
+	}
+	t.Token = token
+	return t, nil
+}
+
+// ListAPITokens userID greater than zero only lists the tokens of that user
+func (m *Mysql) ListAPITokens(ctx context.Context, userID int64) ([]APIToken, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	where := "1=1"
+	args := []interface{}{}
+	if userID > 0 {
+		where = "t.user_id = ?"
+		args = append(args, userID)
+	}
+	rows, err := m.db.QueryContext(ctx, "SELECT "+apiTokenColumns+" FROM api_tokens t JOIN userlogin u ON u.id = t.user_id WHERE "+where+" ORDER BY t.id ASC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []APIToken
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *t)
+	}
+	return list, nil
+}
+
+// LookupAPIToken returns the unrevoked, unexpired token matching the digest and records its use
+func (m *Mysql) LookupAPIToken(ctx context.Context, token string) (*APIToken, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	t, err := scanAPIToken(m.db.QueryRowContext(ctx, "SELECT "+apiTokenColumns+" FROM api_tokens t JOIN userlogin u ON u.id = t.user_id WHERE t.token_hash = ? AND t.revoked_at IS NULL AND (t.expires_at IS NULL OR t.expires_at > CURRENT_TIMESTAMP) LIMIT 1", secretHash(token)))
+	if err != nil || t == nil {
+		return t, err
+	}
+	if _, err := m.db.ExecContext(ctx, "UPDATE api_tokens SET last_used_at = CURRENT_TIMESTAMP WHERE id = ?", t.Id); err != nil {
+		klog.Warningf("update api token usage failed: %v", err)
+	}
+	return t, nil
+}
+
+// RevokeAPIToken userID greater than zero only revokes a token of that user
+func (m *Mysql) RevokeAPIToken(ctx context.Context, id int64, userID int64) (bool, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	query := "UPDATE api_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE id = ? AND revoked_at IS NULL"
+	args := []interface{}{id}
+	if userID > 0 {
+		query += " AND user_id = ?"
+		args = append(args, userID)
+	}
+	res, err := m.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
@@ -0,0 +1,40 @@
+package databases
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+/*
+Passwords
+userlogin.password holds a bcrypt hash. Rows of older versions still hold the
+plaintext, CheckPassword accepts them and reports legacy so the caller can store
+the hash after the first successful login.
+*/
+
+// HashPassword bcrypt with the default cost
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func isPasswordHash(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$")
+}
+
+// CheckPassword compares in constant time, legacy is true when stored is a plaintext password that matched
+func CheckPassword(stored string, password string) (ok bool, legacy bool) {
+	if isPasswordHash(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil, false
+	}
+	if stored == "" {
+		return false, false
+	}
+	ok = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+	return ok, ok
+}
@@ -0,0 +1,18 @@
+// Sends the csrf_token cookie of the session in the X-CSRF-Token header of every request that changes state
+(function(){
+  const origFetch = window.fetch;
+  function csrfToken(){
+    const m = document.cookie.match(/(?:^|;\s*)csrf_token=([^;]*)/);
+    return m ? decodeURIComponent(m[1]) : '';
+  }
+  window.fetch = function(input, init){
+    init = init || {};
+    const method = (init.method || (input instanceof Request ? input.method : 'GET')).toUpperCase();
+    if(method !== 'GET' && method !== 'HEAD'){
+      const headers = new Headers(init.headers || (input instanceof Request ? input.headers : undefined));
+      if(!headers.has('X-CSRF-Token')){ headers.set('X-CSRF-Token', csrfToken()); }
+      init = Object.assign({}, init, {headers});
+    }
+    return origFetch.call(this, input, init);
+  };
+})();
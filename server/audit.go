@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bwrs/databases"
+	"context"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"k8s.io/klog"
+)
+
+/*
+Audit log
+Every non-GET API call is written to audit_log once the handler has finished,
+with the acting user (or ask key prefix), client IP, route, target and status.
+*/
+
+// AuditLog middleware, registered once on the engine
+func AuditLog(database databases.Databases) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		if c.Request.Method == "GET" || c.Request.Method == "HEAD" || c.Request.Method == "OPTIONS" {
+			return
+		}
+		route := c.FullPath()
+		if route == "" || !strings.HasPrefix(route, "/api/") {
+			return
+		}
+		entry := databases.AuditLog{
+			IP:     c.ClientIP(),
+			Method: c.Request.Method,
+			Route:  route,
+			Target: auditTarget(c),
+			Status: c.Writer.Status(),
+		}
+		entry.UserId, entry.Actor = auditActor(c)
+		// the entry is written even when the client has already gone away
+		if err := database.InsertAuditLog(context.WithoutCancel(c.Request.Context()), entry); err != nil {
+			klog.Warningf("write audit log failed: %v", err)
+		}
+	}
+}
+
+// auditActor the session user, the ask key prefix for downloader calls or the username of a login attempt
+func auditActor(c *gin.Context) (int64, string) {
+	if sess, ok := currentSession(c); ok {
+		return sess.UserID, sess.Username
+	}
+	if name := clientCertName(c); name != "" {
+		return 0, "cert:" + name
+	}
+	if ask := askFromRequest(c); ask != "" {
+		return 0, "ask:" + databases.AskDisplayPrefix(ask)
+	}
+	if u := c.PostForm("username"); u != "" && c.FullPath() == "/api/login" {
+		return 0, u
+	}
+	return 0, ""
+}
+
+// auditTargetFields form fields naming the target of calls without route params
+var auditTargetFields = []string{"name", "table", "path", "ids", "hashes"}
+
+// auditTargetKey context key of the target set by handlers that read a JSON body
+const auditTargetKey = "auditTarget"
+
+// setAuditTarget records key=value as the target, for handlers whose target is not in a form field
+func setAuditTarget(c *gin.Context, key string, value string) {
+	c.Set(auditTargetKey, key+"="+value)
+}
+
+// auditTarget the route params (id, hash), the target set by the handler or the first target form field, joined as key=value
+func auditTarget(c *gin.Context) string {
+	parts := make([]string, 0, len(c.Params))
+	for _, p := range c.Params {
+		parts = append(parts, p.Key+"="+p.Value)
+	}
+	if len(parts) == 0 {
+		if v := c.GetString(auditTargetKey); v != "" {
+			parts = append(parts, v)
+		}
+	}
+	if len(parts) == 0 {
+		for _, f := range auditTargetFields {
+			if v := c.PostForm(f); v != "" {
+				parts = append(parts, f+"="+v)
+				break
+			}
+		}
+	}
+	target := strings.Join(parts, " ")
+	if len(target) > 1024 {
+		target = strings.ToValidUTF8(target[:1024], "")
+	}
+	return target
+}
+
+// purgeAuditLogs removes entries older than audit.retentionDays, 0 keeps everything
+func purgeAuditLogs(ctx context.Context, database databases.Databases) {
+	days := currentConfig().Audit.RetentionDays
+	if days <= 0 {
+		return
+	}
+	n, err := database.PurgeAuditLogs(ctx, time.Duration(days)*24*time.Hour)
+	if err != nil {
+		klog.Warningf("purge audit log failed: %v", err)
+		return
+	}
+	if n > 0 {
+		klog.Infof("purged %d audit log entries older than %d days", n, days)
+	}
+}
+
+// scheduleAuditPurge purges on startup and then once a day
+func scheduleAuditPurge(database databases.Databases) {
+	goBackground(func(ctx context.Context) {
+		purgeAuditLogs(ctx, database)
+		ticker := time.NewTicker(24 * time.Hour)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				purgeAuditLogs(ctx, database)
+			}
+		}
+	})
+}
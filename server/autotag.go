@@ -0,0 +1,257 @@
+package server
+
+import (
+	"bwrs/databases"
+	"bwrs/tools"
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+)
+
+/*
+Auto tagging
+Rules come from the config file (autoTag.rules) and from the autotag_rules table,
+every non-empty condition of a rule must match an entry for its tags to be attached.
+Tags are stored through SetDirectoryTags keyed by the entry path.
+*/
+
+type autoTagMatcher struct {
+	rule databases.AutoTagRule
+	re   *regexp.Regexp
+	from time.Time
+	to   time.Time
+}
+
+func compileAutoTagRule(rule databases.AutoTagRule) (*autoTagMatcher, error) {
+	if len(rule.Tags) == 0 {
+		return nil, fmt.Errorf("rule %q has no tags", rule.Name)
+	}
+	if rule.PathGlob == "" && rule.PathRegex == "" && len(rule.Extensions) == 0 && rule.Camera == "" && rule.DateFrom == "" && rule.DateTo == "" {
+		return nil, fmt.Errorf("rule %q has no conditions", rule.Name)
+	}
+	m := &autoTagMatcher{rule: rule}
+	if rule.PathGlob != "" {
+		if _, err := filepath.Match(rule.PathGlob, ""); err != nil {
+			return nil, fmt.Errorf("rule %q invalid glob: %v", rule.Name, err)
+		}
+	}
+	if rule.PathRegex != "" {
+		re, err := regexp.Compile(rule.PathRegex)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q invalid regex: %v", rule.Name, err)
+		}
+		m.re = re
+	}
+	if rule.DateFrom != "" {
+		t, err := time.ParseInLocation("2006-01-02", rule.DateFrom, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q invalid dateFrom: %v", rule.Name, err)
+		}
+		m.from = t
+	}
+	if rule.DateTo != "" {
+		t, err := time.ParseInLocation("2006-01-02", rule.DateTo, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q invalid dateTo: %v", rule.Name, err)
+		}
+		// dateTo is inclusive
+		m.to = t.Add(24 * time.Hour)
+	}
+	return m, nil
+}
+
+func (m *autoTagMatcher) needsExif() bool {
+	return m.rule.Camera != "" || !m.from.IsZero() || !m.to.IsZero()
+}
+
+// match reports whether the entry satisfies every condition, exif is only read when required
+func (m *autoTagMatcher) match(e databases.LocalEntry, exif func() (exifInfo, bool)) bool {
+	if (len(m.rule.Extensions) > 0 || m.rule.Camera != "") && e.Type != "file" {
+		return false
+	}
+	if m.rule.PathGlob != "" {
+		full, _ := filepath.Match(m.rule.PathGlob, e.Path)
+		base, _ := filepath.Match(m.rule.PathGlob, filepath.Base(e.Path))
+		if !full && !base {
+			return false
+		}
+	}
+	if m.re != nil && !m.re.MatchString(e.Path) {
+		return false
+	}
+	if len(m.rule.Extensions) > 0 {
+		ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(e.Path)), ".")
+		found := false
+		for _, x := range m.rule.Extensions {
+			if ext == x {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	var info exifInfo
+	var hasExif bool
+	if m.needsExif() {
+		info, hasExif = exif()
+	}
+	if m.rule.Camera != "" {
+		if !hasExif || !strings.Contains(strings.ToLower(info.Camera()), strings.ToLower(m.rule.Camera)) {
+			return false
+		}
+	}
+	if !m.from.IsZero() || !m.to.IsZero() {
+		t := time.Unix(e.Mtime, 0)
+		if hasExif && !info.Taken.IsZero() {
+			t = info.Taken
+		}
+		if !m.from.IsZero() && t.Before(m.from) {
+			return false
+		}
+		if !m.to.IsZero() && !t.Before(m.to) {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeAutoTagRule trims values and lower-cases extensions without the leading dot
+func normalizeAutoTagRule(rule databases.AutoTagRule) databases.AutoTagRule {
+	rule.Name = strings.TrimSpace(rule.Name)
+	var tags []string
+	for _, t := range rule.Tags {
+		if t = strings.TrimSpace(t); t != "" {
+			tags = append(tags, t)
+		}
+	}
+	rule.Tags = tags
+	var exts []string
+	for _, x := range rule.Extensions {
+		if x = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(x)), "."); x != "" {
+			exts = append(exts, x)
+		}
+	}
+	rule.Extensions = exts
+	rule.PathGlob = strings.TrimSpace(rule.PathGlob)
+	rule.PathRegex = strings.TrimSpace(rule.PathRegex)
+	rule.Camera = strings.TrimSpace(rule.Camera)
+	rule.DateFrom = strings.TrimSpace(rule.DateFrom)
+	rule.DateTo = strings.TrimSpace(rule.DateTo)
+	return rule
+}
+
+func configAutoTagRules(config tools.ServiceConfig) []databases.AutoTagRule {
+	var list []databases.AutoTagRule
+	for _, r := range config.AutoTag.Rules {
+		list = append(list, normalizeAutoTagRule(databases.AutoTagRule{
+			Name:       r.Name,
+			Tags:       r.Tags,
+			PathGlob:   r.PathGlob,
+			PathRegex:  r.PathRegex,
+			Extensions: r.Extensions,
+			Camera:     r.Camera,
+			DateFrom:   r.DateFrom,
+			DateTo:     r.DateTo,
+			Source:     "config",
+		}))
+	}
+	return list
+}
+
+// loadAutoTagRules returns config rules followed by the rules stored in the database
+func loadAutoTagRules(ctx context.Context, database databases.Databases) []databases.AutoTagRule {
+	list := configAutoTagRules(currentConfig())
+	stored, err := database.ListAutoTagRules(ctx)
+	if err != nil {
+		klog.Warningf("list auto tag rules failed: %v", err)
+	}
+	return append(list, stored...)
+}
+
+func loadAutoTagMatchers(ctx context.Context, database databases.Databases) []*autoTagMatcher {
+	var matchers []*autoTagMatcher
+	for _, r := range loadAutoTagRules(ctx, database) {
+		m, err := compileAutoTagRule(r)
+		if err != nil {
+			klog.Warningf("skip auto tag rule: %v", err)
+			continue
+		}
+		matchers = append(matchers, m)
+	}
+	return matchers
+}
+
+// autoTagTags returns the union of tags of all matching rules for an entry
+func autoTagTags(matchers []*autoTagMatcher, e databases.LocalEntry) []string {
+	var cached *exifInfo
+	var cachedOk bool
+	exif := func() (exifInfo, bool) {
+		if cached == nil {
+			info, ok := readExif(e.Path)
+			cached, cachedOk = &info, ok
+		}
+		return *cached, cachedOk
+	}
+	seen := map[string]bool{}
+	var tags []string
+	for _, m := range matchers {
+		if !m.match(e, exif) {
+			continue
+		}
+		for _, t := range m.rule.Tags {
+			if !seen[t] {
+				seen[t] = true
+				tags = append(tags, t)
+			}
+		}
+	}
+	return tags
+}
+
+// applyAutoTags attaches matching tags to every entry and returns how many entries were tagged
+func applyAutoTags(ctx context.Context, database databases.Databases, matchers []*autoTagMatcher, entries []databases.LocalEntry) (int, error) {
+	if len(matchers) == 0 {
+		return 0, nil
+	}
+	tagged := 0
+	for _, e := range entries {
+		tags := autoTagTags(matchers, e)
+		if len(tags) == 0 {
+			continue
+		}
+		if err := database.SetDirectoryTags(ctx, e.Path, tags); err != nil {
+			return tagged, err
+		}
+		tagged++
+	}
+	return tagged, nil
+}
+
+// walkIndexEntries pages through an existing index table
+func walkIndexEntries(ctx context.Context, database databases.Databases, table string, fn func(entries []databases.LocalEntry) error) error {
+	const pageSize = 1000
+	offset := 0
+	for {
+		items, _, err := database.ListLocalIndexEntries(ctx, table, offset, pageSize)
+		if err != nil {
+			return err
+		}
+		if len(items) == 0 {
+			return nil
+		}
+		if err := fn(items); err != nil {
+			return err
+		}
+		if len(items) < pageSize {
+			return nil
+		}
+		offset += pageSize
+	}
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+Minimal EXIF reader
+Only the fields used by the auto tagging rules are extracted:
+camera make/model and the original capture time of a JPEG file
+*/
+
+type exifInfo struct {
+	Make  string
+	Model string
+	Taken time.Time
+}
+
+// Camera make and model joined for matching
+func (e exifInfo) Camera() string {
+	return strings.TrimSpace(e.Make + " " + e.Model)
+}
+
+const (
+	exifTagMake             = 0x010F
+	exifTagModel            = 0x0110
+	exifTagExifIFD          = 0x8769
+	exifTagDateTimeOriginal = 0x9003
+)
+
+func readExif(path string) (exifInfo, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return exifInfo{}, false
+	}
+	defer f.Close()
+	var marker [2]byte
+	if _, err := io.ReadFull(f, marker[:]); err != nil || marker[0] != 0xFF || marker[1] != 0xD8 {
+		return exifInfo{}, false
+	}
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(f, hdr[:]); err != nil || hdr[0] != 0xFF {
+			return exifInfo{}, false
+		}
+		// start of scan or end of image, no APP1 segment found
+		if hdr[1] == 0xDA || hdr[1] == 0xD9 {
+			return exifInfo{}, false
+		}
+		size := int(binary.BigEndian.Uint16(hdr[2:])) - 2
+		if size < 0 {
+			return exifInfo{}, false
+		}
+		if hdr[1] != 0xE1 {
+			if _, err := f.Seek(int64(size), io.SeekCurrent); err != nil {
+				return exifInfo{}, false
+			}
+			continue
+		}
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(f, buf); err != nil {
+			return exifInfo{}, false
+		}
+		if !bytes.HasPrefix(buf, []byte("Exif\x00\x00")) {
+			continue
+		}
+		return parseTiff(buf[6:])
+	}
+}
+
+func parseTiff(b []byte) (exifInfo, bool) {
+	if len(b) < 8 {
+		return exifInfo{}, false
+	}
+	var order binary.ByteOrder
+	switch string(b[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return exifInfo{}, false
+	}
+	var info exifInfo
+	var exifOffset uint32
+	readIFD(b, order, order.Uint32(b[4:]), func(tag uint16, typ uint16, count uint32, value []byte) {
+		switch tag {
+		case exifTagMake:
+			info.Make = tiffString(b, order, typ, count, value)
+		case exifTagModel:
+			info.Model = tiffString(b, order, typ, count, value)
+		case exifTagExifIFD:
+			exifOffset = order.Uint32(value)
+		}
+	})
+	if exifOffset > 0 {
+		readIFD(b, order, exifOffset, func(tag uint16, typ uint16, count uint32, value []byte) {
+			if tag == exifTagDateTimeOriginal {
+				s := tiffString(b, order, typ, count, value)
+				if t, err := time.ParseInLocation("2006:01:02 15:04:05", s, time.Local); err == nil {
+					info.Taken = t
+				}
+			}
+		})
+	}
+	return info, info.Make != "" || info.Model != "" || !info.Taken.IsZero()
+}
+
+func readIFD(b []byte, order binary.ByteOrder, offset uint32, fn func(tag uint16, typ uint16, count uint32, value []byte)) {
+	if int(offset)+2 > len(b) {
+		return
+	}
+	n := int(order.Uint16(b[offset:]))
+	pos := int(offset) + 2
+	for i := 0; i < n; i++ {
+		if pos+12 > len(b) {
+			return
+		}
+		e := b[pos : pos+12]
+		fn(order.Uint16(e[0:]), order.Uint16(e[2:]), order.Uint32(e[4:]), e[8:12])
+		pos += 12
+	}
+}
+
+// tiffString reads an ASCII value, inline when it fits in 4 bytes otherwise from the offset
+func tiffString(b []byte, order binary.ByteOrder, typ uint16, count uint32, value []byte) string {
+	if typ != 2 {
+		return ""
+	}
+	var raw []byte
+	if count <= 4 {
+		raw = value[:count]
+	} else {
+		off := order.Uint32(value)
+		if uint64(off)+uint64(count) > uint64(len(b)) {
+			return ""
+		}
+		raw = b[off : off+count]
+	}
+	return strings.TrimSpace(strings.TrimRight(string(raw), "\x00"))
+}
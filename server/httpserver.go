@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"k8s.io/klog"
+)
+
+/*
+HTTP server lifecycle
+The engine runs in an http.Server with read/write/idle timeouts. SIGINT or SIGTERM
+stops accepting connections, drains in-flight requests, cancels the background jobs
+and waits for them before the caller closes the database.
+*/
+
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultReadTimeout       = time.Minute
+	defaultIdleTimeout       = 2 * time.Minute
+	defaultShutdownTimeout   = 30 * time.Second
+)
+
+// backgroundJobs the scheduled and API started jobs, ctx is cancelled on shutdown
+var backgroundJobs = struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}{}
+
+func init() {
+	backgroundJobs.ctx, backgroundJobs.cancel = context.WithCancel(context.Background())
+}
+
+// goBackground runs fn in a goroutine that shutdown waits for
+func goBackground(fn func(ctx context.Context)) {
+	backgroundJobs.wg.Add(1)
+	go func() {
+		defer backgroundJobs.wg.Done()
+		fn(backgroundJobs.ctx)
+	}()
+}
+
+// stopBackground cancels the jobs and waits for them until ctx is done
+func stopBackground(ctx context.Context) error {
+	backgroundJobs.cancel()
+	done := make(chan struct{})
+	go func() {
+		backgroundJobs.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// configDuration parses a server timeout, empty or invalid values use def
+func configDuration(field string, value string, def time.Duration) time.Duration {
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		klog.Warningf("invalid %s %q, using %s", field, value, def)
+		return def
+	}
+	return d
+}
+
+func newHTTPServer(route *gin.Engine, port int) *http.Server {
+	s := currentConfig().Server
+	return &http.Server{
+		Addr:              fmt.Sprintf(":%d", port),
+		Handler:           route,
+		ReadHeaderTimeout: configDuration("server.readHeaderTimeout", s.ReadHeaderTimeout, defaultReadHeaderTimeout),
+		ReadTimeout:       configDuration("server.readTimeout", s.ReadTimeout, defaultReadTimeout),
+		WriteTimeout:      configDuration("server.writeTimeout", s.WriteTimeout, 0),
+		IdleTimeout:       configDuration("server.idleTimeout", s.IdleTimeout, defaultIdleTimeout),
+	}
+}
+
+/*
+serveHTTP
+Serves over HTTPS when TLS is configured, plain HTTP otherwise, and blocks until
+the listener fails or a shutdown signal has been handled.
+*/
+func serveHTTP(route *gin.Engine, port int) error {
+	srv := newHTTPServer(route, port)
+	servers := []*http.Server{srv}
+	errCh := make(chan error, 2)
+	if tlsEnabled() {
+		t := currentConfig().TLS
+		tlsConfig, err := serverTLSConfig()
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = tlsConfig
+		if t.RedirectPort > 0 {
+			redirect := redirectServer(t.RedirectPort, port)
+			servers = append(servers, redirect)
+			go func() {
+				klog.V(1).Infof("redirect http on port %d to https", t.RedirectPort)
+				if err := redirect.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					klog.Errorf("http redirect server stopped: %v", err)
+				}
+			}()
+		}
+		go func() {
+			klog.V(1).Infof("start gin server on port %d with tls", port)
+			errCh <- srv.ListenAndServeTLS(t.CertFile, t.KeyFile)
+		}()
+	} else {
+		go func() {
+			klog.V(1).Infof("start gin server on port %d", port)
+			errCh <- srv.ListenAndServe()
+		}()
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+	select {
+	case err := <-errCh:
+		_ = stopBackground(context.Background())
+		return err
+	case sig := <-sigCh:
+		klog.Infof("received %s, shutting down", sig)
+	}
+	return shutdown(servers)
+}
+
+// shutdown drains the servers and stops the background jobs within server.shutdownTimeout
+func shutdown(servers []*http.Server) error {
+	timeout := configDuration("server.shutdownTimeout", currentConfig().Server.ShutdownTimeout, defaultShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var firstErr error
+	for _, s := range servers {
+		if err := s.Shutdown(ctx); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("drain requests: %w", err)
+		}
+	}
+	if err := stopBackground(ctx); err != nil && firstErr == nil {
+		firstErr = fmt.Errorf("stop background jobs: %w", err)
+	}
+	if firstErr == nil {
+		klog.Info("server stopped")
+	}
+	return firstErr
+}
@@ -0,0 +1,267 @@
+package server
+
+import (
+	"bufio"
+	"bwrs/databases"
+	"bwrs/tools"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/term"
+	"gopkg.in/yaml.v3"
+	"k8s.io/klog"
+)
+
+/*
+init subcommand
+Prepares a fresh installation and can be run again at any time: a starter config
+is only written when the file is missing, the database and tables are created
+with IF NOT EXISTS and the migrations skip what is already there, an existing
+admin keeps its password unless a new one is given, and the ask key is only
+created when no key with that name exists.
+*/
+
+// initOptions flags of the init subcommand
+var initOptions = struct {
+	adminUser     string
+	adminPassword string
+	askName       string
+	askScopes     string
+}{}
+
+// starterConfig the file written by init when --config does not exist yet,
+// the database values come from the LPT_* variables and --database.* flags
+const starterConfig = `# generated by init, see config.yaml in the repository for every setting
+port: %d
+database:
+  databaseType: %s
+  host: %s
+  port: %d
+  path: %s
+  description:
+    username: %s
+    password: %s
+  connPath: %s
+  basename: %s
+  queryTimeout: 30s
+session:
+  sameSite: lax
+audit:
+  retentionDays: 90
+`
+
+// initSummary what init found or changed, printed at the end
+type initSummary struct {
+	config   string
+	database string
+	admin    string
+	ask      string
+}
+
+func runInit() {
+	path := configFilePath
+	if path == "" {
+		path = resolveConfigPath("config.yaml")
+	}
+	var summary initSummary
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		if err := writeStarterConfig(path); err != nil {
+			klog.Fatalf("write starter config %s failed: %v", path, err)
+		}
+		summary.config = path + " (created, review it before starting)"
+	} else if err != nil {
+		klog.Fatalf("config file %s: %v", path, err)
+	} else {
+		summary.config = path + " (existing, unchanged)"
+	}
+	configFilePath = path
+
+	config := readConfig(path)
+	if problems := validateConfig(config); len(problems) > 0 {
+		problems.report(path)
+		klog.Fatalf("invalid config, fix it and run init again")
+	}
+	setServiceConfig(config)
+
+	ctx := context.Background()
+	db := config.Database
+	fmt.Printf("connecting to %s %s:%d ...\n", db.DataBaseType, db.Host, db.Port)
+	database := initDatabase(config)
+	defer func() { _ = database.Close(ctx) }()
+	summary.database = fmt.Sprintf("%s %s:%d/%s, tables and migrations up to date", db.DataBaseType, db.Host, db.Port, db.Path)
+
+	admin, err := initAdmin(ctx, database)
+	if err != nil {
+		klog.Fatalf("create admin user failed: %v", err)
+	}
+	summary.admin = admin
+	if config.Login.User.Username != "" {
+		summary.admin += fmt.Sprintf("; login.user %s is created as admin on start when missing", config.Login.User.Username)
+	}
+
+	ask, err := initAsk(ctx, database)
+	if err != nil {
+		klog.Fatalf("create ask key failed: %v", err)
+	}
+	summary.ask = ask
+
+	fmt.Println()
+	fmt.Printf("config:   %s\n", summary.config)
+	fmt.Printf("database: %s\n", summary.database)
+	fmt.Printf("admin:    %s\n", summary.admin)
+	fmt.Printf("ask key:  %s\n", summary.ask)
+	fmt.Printf("\nstart the server with: %s --config %s\n", filepath.Base(os.Args[0]), path)
+}
+
+// writeStarterConfig creates the file with mode 0600 since it holds the database password
+func writeStarterConfig(path string) error {
+	// defaults, then the same overrides start applies
+	cfg := tools.ServiceConfig{Port: 8080}
+	cfg.Database.DataBaseType = "mysql"
+	cfg.Database.Host = "127.0.0.1"
+	cfg.Database.Port = 3306
+	cfg.Database.Path = "local_picture_tools"
+	cfg.Database.Description.Username = "root"
+	if err := tools.ApplyEnvOverrides(&cfg); err != nil {
+		return err
+	}
+	if err := applyConfigFlags(&cfg); err != nil {
+		return err
+	}
+	db := cfg.Database
+	content := fmt.Sprintf(starterConfig, cfg.Port, yamlQuote(db.DataBaseType), yamlQuote(db.Host), db.Port,
+		yamlQuote(db.Path), yamlQuote(db.Description.Username), yamlQuote(db.Description.Password),
+		yamlQuote(db.ConnPath), yamlQuote(db.BaseName))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(content), 0o600)
+}
+
+// yamlQuote renders s as a yaml scalar, quoting it when needed
+func yamlQuote(s string) string {
+	out, err := yaml.Marshal(s)
+	if err != nil {
+		return fmt.Sprintf("%q", s)
+	}
+	return strings.TrimSuffix(string(out), "\n")
+}
+
+/*
+initAdmin
+Takes the admin from --admin-user/--admin-password or asks for it on a terminal.
+An existing user is only changed when a password is given, and then becomes an enabled admin.
+*/
+func initAdmin(ctx context.Context, database databases.Databases) (string, error) {
+	interactive := term.IsTerminal(int(os.Stdin.Fd()))
+	in := bufio.NewReader(os.Stdin)
+	username := strings.TrimSpace(initOptions.adminUser)
+	if username == "" {
+		if !interactive {
+			return "skipped, pass --admin-user and --admin-password to create one", nil
+		}
+		username = prompt(in, "admin username [admin]: ")
+		if username == "" {
+			username = "admin"
+		}
+	}
+	existing, err := database.GetUserByUsername(ctx, username)
+	if err != nil {
+		return "", err
+	}
+	password := initOptions.adminPassword
+	if password == "" {
+		if existing != nil {
+			return fmt.Sprintf("%s (existing %s, unchanged)", username, existing.Role), nil
+		}
+		if !interactive {
+			return "", fmt.Errorf("--admin-password is required to create %s", username)
+		}
+		if password, err = promptPassword(); err != nil {
+			return "", err
+		}
+	}
+	if len(password) < minPasswordLength {
+		return "", fmt.Errorf("password must have at least %d characters", minPasswordLength)
+	}
+	if existing == nil {
+		if _, err := database.CreateUser(ctx, username, password, roleAdmin); err != nil {
+			return "", err
+		}
+		return username + " (created)", nil
+	}
+	if err := database.SetUserPassword(ctx, existing.Id, password); err != nil {
+		return "", err
+	}
+	if err := database.SetUserRole(ctx, existing.Id, roleAdmin); err != nil {
+		return "", err
+	}
+	if err := database.SetUserDisabled(ctx, existing.Id, false); err != nil {
+		return "", err
+	}
+	return username + " (existing, password updated and role set to admin)", nil
+}
+
+func prompt(in *bufio.Reader, label string) string {
+	fmt.Print(label)
+	line, _ := in.ReadString('\n')
+	return strings.TrimSpace(line)
+}
+
+// promptPassword reads the password twice without echoing it
+func promptPassword() (string, error) {
+	read := func(label string) (string, error) {
+		fmt.Print(label)
+		b, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Println()
+		return string(b), err
+	}
+	password, err := read("admin password: ")
+	if err != nil {
+		return "", err
+	}
+	again, err := read("repeat password: ")
+	if err != nil {
+		return "", err
+	}
+	if password != again {
+		return "", errors.New("passwords do not match")
+	}
+	return password, nil
+}
+
+// initAsk creates the --ask-name key unless one with that name exists, the secret is only shown once
+func initAsk(ctx context.Context, database databases.Databases) (string, error) {
+	name := strings.TrimSpace(initOptions.askName)
+	if name == "" {
+		return "skipped, pass --ask-name to create one", nil
+	}
+	var scopes []string
+	for _, sc := range strings.Split(initOptions.askScopes, ",") {
+		if sc = strings.TrimSpace(sc); sc == "" {
+			continue
+		}
+		if !askScopes[sc] {
+			return "", fmt.Errorf("invalid scope %s, use duplicate or save", sc)
+		}
+		scopes = append(scopes, sc)
+	}
+	keys, err := database.ListAsk(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, k := range keys {
+		if k.Name == name {
+			return fmt.Sprintf("%s (existing, %s...)", name, k.Prefix), nil
+		}
+	}
+	key, err := database.CreateAsk(ctx, name, scopes, 0)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s (created) %s  <- store it now, it is not shown again", name, key.Ask), nil
+}
@@ -0,0 +1,668 @@
+package server
+
+import (
+	"bwrs/databases"
+	"bwrs/tools"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"k8s.io/klog"
+)
+
+/*
+OIDC
+Optional OpenID Connect login using the authorization code flow with PKCE.
+The ID token is verified against the provider JWKS, claims are mapped to a local
+user and role, and the login ends in the same cookie session as a password login.
+*/
+
+const (
+	// oidcStateTTL how long a started login may take at the provider
+	oidcStateTTL = 10 * time.Minute
+	// oidcMaxStates pending logins kept in memory, further logins are refused until some complete or expire
+	oidcMaxStates = 1000
+)
+
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+// oidcProvider discovery document and signing keys, the keys are refetched when an unknown kid shows up
+var oidcProvider = struct {
+	mu      sync.Mutex
+	issuer  string
+	meta    *oidcMetadata
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}{}
+
+type oidcState struct {
+	Nonce    string
+	Verifier string
+	Redirect string
+	Expires  time.Time
+}
+
+var oidcStates = struct {
+	mu sync.Mutex
+	m  map[string]oidcState
+}{
+	m: make(map[string]oidcState),
+}
+
+func oidcEnabled() bool {
+	o := currentConfig().OIDC
+	return o.Issuer != "" && o.ClientID != ""
+}
+
+func oidcGetJSON(u string, out any) error {
+	resp, err := oidcClient.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// oidcDiscover loads the provider metadata once per issuer
+func oidcDiscover(issuer string) (*oidcMetadata, error) {
+	oidcProvider.mu.Lock()
+	defer oidcProvider.mu.Unlock()
+	if oidcProvider.meta != nil && oidcProvider.issuer == issuer {
+		return oidcProvider.meta, nil
+	}
+	var meta oidcMetadata
+	if err := oidcGetJSON(strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", &meta); err != nil {
+		return nil, err
+	}
+	if meta.Issuer != issuer {
+		return nil, fmt.Errorf("discovery issuer %q does not match %q", meta.Issuer, issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JwksURI == "" {
+		return nil, fmt.Errorf("incomplete discovery document")
+	}
+	oidcProvider.issuer = issuer
+	oidcProvider.meta = &meta
+	oidcProvider.keys = nil
+	return &meta, nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func b64Int(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := b64Int(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64Int(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := b64Int(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64Int(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+// oidcKey returns the signing key with kid, refreshing the JWKS at most once a minute
+func oidcKey(meta *oidcMetadata, kid string) (crypto.PublicKey, error) {
+	oidcProvider.mu.Lock()
+	defer oidcProvider.mu.Unlock()
+	if key, ok := oidcProvider.keys[kid]; ok {
+		return key, nil
+	}
+	if oidcProvider.keys != nil && time.Since(oidcProvider.fetched) < time.Minute {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := oidcGetJSON(meta.JwksURI, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			klog.V(2).Infof("oidc: skip jwk %q: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	oidcProvider.keys = keys
+	oidcProvider.fetched = time.Now()
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	// a provider publishing a single key may omit kid from the token header
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed []byte, sig []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported alg %s", alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("alg %s does not match rsa key", alg)
+		}
+		return rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") {
+			return fmt.Errorf("alg %s does not match ec key", alg)
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return fmt.Errorf("invalid ecdsa signature length")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key")
+}
+
+/*
+verifyIDToken
+Checks the signature, issuer, audience, expiry and nonce of an ID token and returns its claims.
+*/
+func verifyIDToken(meta *oidcMetadata, cfg tools.OIDCConfig, rawToken string, nonce string) (map[string]any, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed id token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(headerJSON, &header) != nil {
+		return nil, fmt.Errorf("malformed id token header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed id token signature")
+	}
+	key, err := oidcKey(meta, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWTSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed id token payload")
+	}
+	var claims map[string]any
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("malformed id token payload")
+	}
+	if iss, _ := claims["iss"].(string); iss != cfg.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %q", iss)
+	}
+	if !containsString(claimStrings(claims["aud"]), cfg.ClientID) {
+		return nil, fmt.Errorf("id token not issued for this client")
+	}
+	now := time.Now().Unix()
+	const leeway = 60
+	exp, _ := claims["exp"].(float64)
+	if int64(exp)+leeway < now {
+		return nil, fmt.Errorf("id token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && int64(nbf)-leeway > now {
+		return nil, fmt.Errorf("id token not yet valid")
+	}
+	if n, _ := claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(n), []byte(nonce)) != 1 {
+		return nil, fmt.Errorf("nonce mismatch")
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, fmt.Errorf("id token without subject")
+	}
+	return claims, nil
+}
+
+// claimStrings a claim that may be a single string or a list of strings
+func claimStrings(v any) []string {
+	switch t := v.(type) {
+	case string:
+		return []string{t}
+	case []any:
+		out := make([]string, 0, len(t))
+		for _, it := range t {
+			if s, ok := it.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, it := range list {
+		if it == s {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcUsername the configured username claim, then preferred_username, email and sub
+func oidcUsername(cfg tools.OIDCConfig, claims map[string]any) string {
+	for _, name := range []string{cfg.UsernameClaim, "preferred_username", "email", "sub"} {
+		if name == "" {
+			continue
+		}
+		if s, _ := claims[name].(string); s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+// oidcLinkCandidate the unlinked local user named by the linkClaim value or by a verified email, nil when there is none
+func oidcLinkCandidate(ctx context.Context, database databases.Databases, cfg tools.OIDCConfig, claims map[string]any) (*databases.UserLogin, error) {
+	var names []string
+	if cfg.LinkClaim != "" {
+		if v, _ := claims[cfg.LinkClaim].(string); v != "" {
+			names = append(names, v)
+		}
+	}
+	if verified, _ := claims["email_verified"].(bool); verified {
+		if v, _ := claims["email"].(string); v != "" {
+			names = append(names, v)
+		}
+	}
+	for _, name := range names {
+		u, err := database.GetUserByUsername(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if u != nil && u.OIDCSubject == "" {
+			return u, nil
+		}
+	}
+	return nil, nil
+}
+
+// oidcRole the highest role mapped from the role claim, empty when nothing matches
+func oidcRole(cfg tools.OIDCConfig, claims map[string]any) string {
+	claim := cfg.RoleClaim
+	if claim == "" {
+		claim = "groups"
+	}
+	role := ""
+	for _, v := range claimStrings(claims[claim]) {
+		if r, ok := cfg.Roles[v]; ok && roleRank[r] > roleRank[role] {
+			role = r
+		}
+	}
+	return role
+}
+
+func oidcDefaultRole(cfg tools.OIDCConfig) string {
+	if _, ok := roleRank[cfg.DefaultRole]; ok && cfg.DefaultRole != "" {
+		return cfg.DefaultRole
+	}
+	return roleViewer
+}
+
+// oidcRedirectURL the configured callback, or the callback on the host the browser used
+func oidcRedirectURL(c *gin.Context) string {
+	if u := currentConfig().OIDC.RedirectURL; u != "" {
+		return u
+	}
+	scheme := "http"
+	if secureCookies(c) {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host + "/api/oidc/callback"
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// OIDCInfo tells the login page whether to show the single sign-on button
+func OIDCInfo(c *gin.Context) {
+	name := currentConfig().OIDC.DisplayName
+	if name == "" {
+		name = "OIDC"
+	}
+	c.JSON(200, gin.H{"enabled": oidcEnabled(), "name": name})
+}
+
+// OIDCLogin redirects the browser to the provider authorization endpoint
+func OIDCLogin(c *gin.Context) {
+	if !oidcEnabled() {
+		c.JSON(404, gin.H{"error": "oidc not configured"})
+		return
+	}
+	cfg := currentConfig().OIDC
+	meta, err := oidcDiscover(cfg.Issuer)
+	if err != nil {
+		klog.Errorf("oidc discovery failed: %v", err)
+		c.JSON(502, gin.H{"error": "oidc provider unavailable"})
+		return
+	}
+	state := randomToken()
+	st := oidcState{
+		Nonce:    randomToken(),
+		Verifier: randomToken(),
+		Redirect: oidcRedirectURL(c),
+		Expires:  time.Now().Add(oidcStateTTL),
+	}
+	oidcStates.mu.Lock()
+	for k, v := range oidcStates.m {
+		if time.Now().After(v.Expires) {
+			delete(oidcStates.m, k)
+		}
+	}
+	if len(oidcStates.m) >= oidcMaxStates {
+		oidcStates.mu.Unlock()
+		klog.Warningf("oidc: %d logins pending, refusing new ones", oidcMaxStates)
+		c.Header("Retry-After", "60")
+		c.JSON(503, gin.H{"error": "too many pending logins"})
+		return
+	}
+	oidcStates.m[state] = st
+	oidcStates.mu.Unlock()
+	scopes := cfg.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "profile", "email"}
+	} else if !containsString(scopes, "openid") {
+		scopes = append([]string{"openid"}, scopes...)
+	}
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", cfg.ClientID)
+	q.Set("redirect_uri", st.Redirect)
+	q.Set("scope", strings.Join(scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", st.Nonce)
+	q.Set("code_challenge", pkceChallenge(st.Verifier))
+	q.Set("code_challenge_method", "S256")
+	target := meta.AuthorizationEndpoint
+	if strings.Contains(target, "?") {
+		target += "&" + q.Encode()
+	} else {
+		target += "?" + q.Encode()
+	}
+	// the state cookie binds the callback to the browser that started the login
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie("oidc_state", state, int(oidcStateTTL.Seconds()), "/api/oidc", "", secureCookies(c), true)
+	c.Redirect(302, target)
+}
+
+// oidcExchange trades the authorization code for the raw ID token
+func oidcExchange(meta *oidcMetadata, cfg tools.OIDCConfig, code string, st oidcState) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", st.Redirect)
+	form.Set("code_verifier", st.Verifier)
+	form.Set("client_id", cfg.ClientID)
+	req, err := http.NewRequest("POST", meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(cfg.ClientID), url.QueryEscape(cfg.ClientSecret))
+	}
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("token endpoint: %s", resp.Status)
+	}
+	if resp.StatusCode != 200 || body.Error != "" {
+		return "", fmt.Errorf("token endpoint: %s %s %s", resp.Status, body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", fmt.Errorf("token response without id_token")
+	}
+	return body.IDToken, nil
+}
+
+/*
+oidcUser
+Finds the local user linked to the subject, otherwise links an unlinked user named by
+a verified email or by the linkClaim (linkExistingUsers) or provisions a new one
+(autoProvision). Any other unlinked user with the same username has to be linked by
+an admin. When roles are mapped the user's role follows the provider on every login.
+*/
+func oidcUser(ctx context.Context, database databases.Databases, cfg tools.OIDCConfig, claims map[string]any) (*databases.UserLogin, error) {
+	sub, _ := claims["sub"].(string)
+	subject := cfg.Issuer + "|" + sub
+	u, err := database.GetUserByOIDCSubject(ctx, subject)
+	if err != nil {
+		return nil, err
+	}
+	mapped := oidcRole(cfg, claims)
+	if u == nil && cfg.LinkExistingUsers {
+		if u, err = oidcLinkCandidate(ctx, database, cfg, claims); err != nil {
+			return nil, err
+		}
+		if u != nil {
+			klog.Infof("oidc: link existing user %s to %s", u.Username, subject)
+		}
+	}
+	if u == nil {
+		username := oidcUsername(cfg, claims)
+		if username == "" {
+			return nil, fmt.Errorf("no username claim")
+		}
+		existing, err := database.GetUserByUsername(ctx, username)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case existing != nil && existing.OIDCSubject == "":
+			// usernames such as preferred_username can be picked by the user at the provider
+			return nil, fmt.Errorf("username %q belongs to an unlinked local user, an admin has to link subject %s to it", username, subject)
+		case existing != nil:
+			return nil, fmt.Errorf("username %q is already taken by another account", username)
+		case cfg.AutoProvision:
+			role := mapped
+			if role == "" {
+				role = oidcDefaultRole(cfg)
+			}
+			// the random password is never revealed, the account can only log in through the provider
+			id, err := database.CreateUser(ctx, username, randomToken(), role)
+			if err != nil {
+				return nil, err
+			}
+			if u, err = database.GetUserByID(ctx, id); err != nil || u == nil {
+				return nil, fmt.Errorf("load provisioned user failed: %v", err)
+			}
+			klog.Infof("oidc: provisioned user %s with role %s", username, role)
+		default:
+			return nil, fmt.Errorf("no local user for %q", username)
+		}
+	}
+	if u.OIDCSubject == "" {
+		if err := database.SetUserOIDCSubject(ctx, u.Id, subject); err != nil {
+			return nil, err
+		}
+		u.OIDCSubject = subject
+	}
+	if len(cfg.Roles) > 0 {
+		role := mapped
+		if role == "" {
+			role = oidcDefaultRole(cfg)
+		}
+		if role != u.Role {
+			last, err := isLastAdmin(ctx, database, u)
+			if err != nil {
+				return nil, err
+			}
+			if last {
+				klog.Warningf("oidc: keep role of %s, it is the last admin", u.Username)
+			} else {
+				if err := database.SetUserRole(ctx, u.Id, role); err != nil {
+					return nil, err
+				}
+				u.Role = role
+			}
+		}
+	}
+	return u, nil
+}
+
+// oidcFail sends the browser back to the login page with a short reason
+func oidcFail(c *gin.Context, reason string, err error) {
+	if err != nil {
+		klog.Warningf("oidc login failed: %s: %v", reason, err)
+	}
+	c.Redirect(302, "/login?oidc_error="+url.QueryEscape(reason))
+}
+
+// OIDCCallback completes the authorization code flow and starts a session
+func OIDCCallback(c *gin.Context, database databases.Databases) {
+	if !oidcEnabled() {
+		c.JSON(404, gin.H{"error": "oidc not configured"})
+		return
+	}
+	if e := c.Query("error"); e != "" {
+		oidcFail(c, e, fmt.Errorf("%s", c.Query("error_description")))
+		return
+	}
+	state := c.Query("state")
+	cookie, _ := c.Cookie("oidc_state")
+	c.SetCookie("oidc_state", "", -1, "/api/oidc", "", secureCookies(c), true)
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(cookie)) != 1 {
+		oidcFail(c, "invalid state", nil)
+		return
+	}
+	oidcStates.mu.Lock()
+	st, ok := oidcStates.m[state]
+	delete(oidcStates.m, state)
+	oidcStates.mu.Unlock()
+	if !ok || time.Now().After(st.Expires) {
+		oidcFail(c, "login expired", nil)
+		return
+	}
+	cfg := currentConfig().OIDC
+	meta, err := oidcDiscover(cfg.Issuer)
+	if err != nil {
+		oidcFail(c, "provider unavailable", err)
+		return
+	}
+	rawToken, err := oidcExchange(meta, cfg, c.Query("code"), st)
+	if err != nil {
+		oidcFail(c, "code exchange failed", err)
+		return
+	}
+	claims, err := verifyIDToken(meta, cfg, rawToken, st.Nonce)
+	if err != nil {
+		oidcFail(c, "invalid id token", err)
+		return
+	}
+	u, err := oidcUser(c.Request.Context(), database, cfg, claims)
+	if err != nil {
+		oidcFail(c, "no matching user", err)
+		return
+	}
+	if u.Disabled {
+		oidcFail(c, "account disabled", nil)
+		return
+	}
+	startSession(c, database, u)
+	c.Redirect(302, "/")
+}
@@ -0,0 +1,432 @@
+package server
+
+import (
+	"bwrs/databases"
+	"bwrs/tools"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const testClientID = "bwrs-test"
+
+// mockProvider an OIDC provider serving discovery, JWKS and a token endpoint that
+// returns an ID token for the nonce of the last authorization request
+type mockProvider struct {
+	srv    *httptest.Server
+	key    *rsa.PrivateKey
+	signer *rsa.PrivateKey
+
+	mu        sync.Mutex
+	nonce     string
+	challenge string
+	claims    map[string]any
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &mockProvider{key: key, signer: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(oidcMetadata{
+			Issuer:                p.srv.URL,
+			AuthorizationEndpoint: p.srv.URL + "/authorize",
+			TokenEndpoint:         p.srv.URL + "/token",
+			JwksURI:               p.srv.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		e := big.NewInt(int64(key.E)).Bytes()
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []jsonWebKey{{
+			Kty: "RSA",
+			Kid: "test",
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(e),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if r.PostFormValue("client_id") != testClientID || pkceChallenge(r.PostFormValue("code_verifier")) != p.challenge {
+			w.WriteHeader(400)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"id_token": p.sign(t)})
+	})
+	p.srv = httptest.NewServer(mux)
+	t.Cleanup(p.srv.Close)
+	return p
+}
+
+// sign the default claims merged with p.claims, a nil value removes a claim
+func (p *mockProvider) sign(t *testing.T) string {
+	now := time.Now()
+	claims := map[string]any{
+		"iss":                p.srv.URL,
+		"aud":                testClientID,
+		"sub":                "alice-sub",
+		"iat":                now.Unix(),
+		"exp":                now.Add(5 * time.Minute).Unix(),
+		"nonce":              p.nonce,
+		"preferred_username": "alice",
+	}
+	for k, v := range p.claims {
+		if v == nil {
+			delete(claims, k)
+		} else {
+			claims[k] = v
+		}
+	}
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Error(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.signer, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Error(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// fakeUsers the user methods OIDC login needs, everything else panics through the nil interface
+type fakeUsers struct {
+	databases.Databases
+	mu    sync.Mutex
+	users []databases.UserLogin
+}
+
+func (f *fakeUsers) find(match func(u databases.UserLogin) bool) *databases.UserLogin {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, u := range f.users {
+		if match(u) {
+			return &u
+		}
+	}
+	return nil
+}
+
+func (f *fakeUsers) update(id int64, change func(u *databases.UserLogin)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.users {
+		if f.users[i].Id == id {
+			change(&f.users[i])
+		}
+	}
+}
+
+func (f *fakeUsers) GetUserByOIDCSubject(ctx context.Context, subject string) (*databases.UserLogin, error) {
+	return f.find(func(u databases.UserLogin) bool { return u.OIDCSubject == subject }), nil
+}
+
+func (f *fakeUsers) GetUserByUsername(ctx context.Context, username string) (*databases.UserLogin, error) {
+	return f.find(func(u databases.UserLogin) bool { return u.Username == username }), nil
+}
+
+func (f *fakeUsers) GetUserByID(ctx context.Context, id int64) (*databases.UserLogin, error) {
+	return f.find(func(u databases.UserLogin) bool { return u.Id == id }), nil
+}
+
+func (f *fakeUsers) ListUsers(ctx context.Context) ([]databases.UserLogin, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]databases.UserLogin(nil), f.users...), nil
+}
+
+func (f *fakeUsers) CreateUser(ctx context.Context, username string, password string, role string) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := int64(len(f.users) + 1)
+	f.users = append(f.users, databases.UserLogin{Id: id, Username: username, Password: password, Role: role})
+	return id, nil
+}
+
+func (f *fakeUsers) SetUserRole(ctx context.Context, id int64, role string) error {
+	f.update(id, func(u *databases.UserLogin) { u.Role = role })
+	return nil
+}
+
+func (f *fakeUsers) SetUserOIDCSubject(ctx context.Context, id int64, subject string) error {
+	f.update(id, func(u *databases.UserLogin) { u.OIDCSubject = subject })
+	return nil
+}
+
+func (f *fakeUsers) SetUserToken(ctx context.Context, id int64, token string) error {
+	f.update(id, func(u *databases.UserLogin) { u.Token = token })
+	return nil
+}
+
+// setupOIDC points the config at a fresh mock provider
+func setupOIDC(t *testing.T, change func(cfg *tools.OIDCConfig)) *mockProvider {
+	t.Helper()
+	p := newMockProvider(t)
+	previous := currentConfig()
+	cfg := previous
+	cfg.OIDC = tools.OIDCConfig{Issuer: p.srv.URL, ClientID: testClientID}
+	if change != nil {
+		change(&cfg.OIDC)
+	}
+	setServiceConfig(cfg)
+	resetOIDCProvider()
+	t.Cleanup(func() {
+		setServiceConfig(previous)
+		resetOIDCProvider()
+	})
+	return p
+}
+
+func resetOIDCProvider() {
+	oidcProvider.mu.Lock()
+	oidcProvider.issuer = ""
+	oidcProvider.meta = nil
+	oidcProvider.keys = nil
+	oidcProvider.mu.Unlock()
+}
+
+func oidcRouter(database databases.Databases) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/oidc/login", OIDCLogin)
+	r.GET("/api/oidc/callback", func(c *gin.Context) {
+		OIDCCallback(c, database)
+	})
+	return r
+}
+
+// oidcFlow starts a login, lets the provider answer it and returns the callback response,
+// tamper may change the callback state and cookie
+func oidcFlow(t *testing.T, p *mockProvider, database databases.Databases, tamper func(state, cookie *string)) *httptest.ResponseRecorder {
+	t.Helper()
+	r := oidcRouter(database)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/oidc/login", nil))
+	if w.Code != 302 {
+		t.Fatalf("login: status %d, body %s", w.Code, w.Body.String())
+	}
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(loc.String(), p.srv.URL+"/authorize?") {
+		t.Fatalf("login redirects to %s", loc)
+	}
+	q := loc.Query()
+	p.mu.Lock()
+	p.nonce = q.Get("nonce")
+	p.challenge = q.Get("code_challenge")
+	p.mu.Unlock()
+	var cookie string
+	for _, ck := range w.Result().Cookies() {
+		if ck.Name == "oidc_state" {
+			cookie = ck.Value
+		}
+	}
+	state := q.Get("state")
+	if cookie != state {
+		t.Fatalf("state cookie %q does not match state %q", cookie, state)
+	}
+	if tamper != nil {
+		tamper(&state, &cookie)
+	}
+	req := httptest.NewRequest("GET", "/api/oidc/callback?code=test-code&state="+url.QueryEscape(state), nil)
+	req.AddCookie(&http.Cookie{Name: "oidc_state", Value: cookie})
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// oidcResult the failure reason of a callback, empty when a session was started
+func oidcResult(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	if w.Code != 302 {
+		t.Fatalf("callback: status %d, body %s", w.Code, w.Body.String())
+	}
+	loc, _ := url.Parse(w.Header().Get("Location"))
+	if loc.Path == "/login" {
+		return loc.Query().Get("oidc_error")
+	}
+	for _, ck := range w.Result().Cookies() {
+		if ck.Name == "session_token" && ck.Value != "" {
+			return ""
+		}
+	}
+	t.Fatalf("callback redirected to %s without a session", loc)
+	return ""
+}
+
+func TestOIDCLogin(t *testing.T) {
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name   string
+		claims map[string]any
+		signer *rsa.PrivateKey
+		tamper func(state, cookie *string)
+		want   string
+	}{
+		{name: "valid"},
+		{name: "bad signature", signer: other, want: "invalid id token"},
+		{name: "wrong audience", claims: map[string]any{"aud": "someone-else"}, want: "invalid id token"},
+		{name: "wrong issuer", claims: map[string]any{"iss": "https://evil.example"}, want: "invalid id token"},
+		{name: "expired", claims: map[string]any{"exp": time.Now().Add(-time.Hour).Unix()}, want: "invalid id token"},
+		{name: "nonce mismatch", claims: map[string]any{"nonce": "replayed"}, want: "invalid id token"},
+		{name: "without nonce", claims: map[string]any{"nonce": nil}, want: "invalid id token"},
+		{name: "state mismatch", tamper: func(state, cookie *string) { *cookie = randomToken() }, want: "invalid state"},
+		{name: "unknown state", tamper: func(state, cookie *string) { *state = randomToken(); *cookie = *state }, want: "login expired"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := setupOIDC(t, nil)
+			p.claims = tc.claims
+			if tc.signer != nil {
+				p.signer = tc.signer
+			}
+			db := &fakeUsers{users: []databases.UserLogin{
+				{Id: 1, Username: "alice", Role: roleEditor, OIDCSubject: p.srv.URL + "|alice-sub"},
+			}}
+			if got := oidcResult(t, oidcFlow(t, p, db, tc.tamper)); got != tc.want {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+			if u, _ := db.GetUserByID(context.Background(), 1); tc.want == "" && u.Token == "" {
+				t.Fatal("no session token stored for the user")
+			}
+		})
+	}
+}
+
+func TestOIDCAutoProvisionRoles(t *testing.T) {
+	p := setupOIDC(t, func(cfg *tools.OIDCConfig) {
+		cfg.AutoProvision = true
+		cfg.Roles = map[string]string{"photo-admins": roleAdmin, "photo-editors": roleEditor}
+	})
+	db := &fakeUsers{users: []databases.UserLogin{{Id: 1, Username: "root", Role: roleAdmin}}}
+
+	p.claims = map[string]any{"groups": []string{"staff", "photo-editors"}}
+	if got := oidcResult(t, oidcFlow(t, p, db, nil)); got != "" {
+		t.Fatalf("first login failed: %s", got)
+	}
+	u, _ := db.GetUserByUsername(context.Background(), "alice")
+	if u == nil {
+		t.Fatal("user was not provisioned")
+	}
+	if u.Role != roleEditor || u.OIDCSubject != p.srv.URL+"|alice-sub" {
+		t.Fatalf("provisioned %+v, want editor linked to the subject", *u)
+	}
+
+	// the highest mapped role wins and follows the provider on later logins
+	p.claims = map[string]any{"groups": []string{"photo-editors", "photo-admins"}}
+	if got := oidcResult(t, oidcFlow(t, p, db, nil)); got != "" {
+		t.Fatalf("second login failed: %s", got)
+	}
+	if u, _ = db.GetUserByUsername(context.Background(), "alice"); u.Role != roleAdmin {
+		t.Fatalf("role %s, want admin", u.Role)
+	}
+
+	p.claims = map[string]any{"sub": "bob-sub", "preferred_username": "bob", "groups": nil}
+	if got := oidcResult(t, oidcFlow(t, p, db, nil)); got != "" {
+		t.Fatalf("login without groups failed: %s", got)
+	}
+	if u, _ = db.GetUserByUsername(context.Background(), "bob"); u == nil || u.Role != roleViewer {
+		t.Fatalf("user without groups %+v, want viewer", u)
+	}
+}
+
+func TestOIDCLinkByEmail(t *testing.T) {
+	for _, verified := range []bool{false, true} {
+		p := setupOIDC(t, func(cfg *tools.OIDCConfig) {
+			cfg.UsernameClaim = "email"
+			cfg.LinkExistingUsers = true
+		})
+		p.claims = map[string]any{"email": "bob@example.com", "email_verified": verified}
+		db := &fakeUsers{users: []databases.UserLogin{{Id: 1, Username: "bob@example.com", Role: roleAdmin}}}
+		got := oidcResult(t, oidcFlow(t, p, db, nil))
+		u, _ := db.GetUserByID(context.Background(), 1)
+		if verified && (got != "" || u.OIDCSubject == "") {
+			t.Fatalf("verified email: got %q, subject %q", got, u.OIDCSubject)
+		}
+		if !verified && (got != "no matching user" || u.OIDCSubject != "") {
+			t.Fatalf("unverified email: got %q, subject %q", got, u.OIDCSubject)
+		}
+	}
+}
+
+func TestOIDCLinkNotByUsername(t *testing.T) {
+	p := setupOIDC(t, func(cfg *tools.OIDCConfig) {
+		cfg.LinkExistingUsers = true
+		cfg.AutoProvision = true
+	})
+	// anyone may pick preferred_username at the provider, and an unverified email proves nothing either
+	p.claims = map[string]any{"sub": "mallory-sub", "preferred_username": "admin", "email": "admin", "email_verified": false}
+	db := &fakeUsers{users: []databases.UserLogin{{Id: 1, Username: "admin", Role: roleAdmin}}}
+	if got := oidcResult(t, oidcFlow(t, p, db, nil)); got != "no matching user" {
+		t.Fatalf("got %q, want the login refused", got)
+	}
+	if u, _ := db.GetUserByID(context.Background(), 1); u.OIDCSubject != "" || u.Token != "" {
+		t.Fatalf("admin was taken over: %+v", *u)
+	}
+	if users, _ := db.ListUsers(context.Background()); len(users) != 1 {
+		t.Fatalf("%d users, want no provisioned duplicate", len(users))
+	}
+}
+
+func TestOIDCLinkClaim(t *testing.T) {
+	p := setupOIDC(t, func(cfg *tools.OIDCConfig) {
+		cfg.LinkExistingUsers = true
+		cfg.LinkClaim = "employee_id"
+	})
+	p.claims = map[string]any{"preferred_username": "alice.w", "employee_id": "alice"}
+	db := &fakeUsers{users: []databases.UserLogin{{Id: 1, Username: "alice", Role: roleEditor}}}
+	if got := oidcResult(t, oidcFlow(t, p, db, nil)); got != "" {
+		t.Fatalf("login failed: %s", got)
+	}
+	if u, _ := db.GetUserByID(context.Background(), 1); u.OIDCSubject != p.srv.URL+"|alice-sub" {
+		t.Fatalf("subject %q, want the user linked by employee_id", u.OIDCSubject)
+	}
+}
+
+func TestOIDCPendingLoginCap(t *testing.T) {
+	setupOIDC(t, nil)
+	oidcStates.mu.Lock()
+	saved := oidcStates.m
+	oidcStates.m = make(map[string]oidcState, oidcMaxStates)
+	for i := 0; i < oidcMaxStates; i++ {
+		oidcStates.m[randomToken()] = oidcState{Expires: time.Now().Add(time.Minute)}
+	}
+	oidcStates.mu.Unlock()
+	t.Cleanup(func() {
+		oidcStates.mu.Lock()
+		oidcStates.m = saved
+		oidcStates.mu.Unlock()
+	})
+	w := httptest.NewRecorder()
+	oidcRouter(&fakeUsers{}).ServeHTTP(w, httptest.NewRequest("GET", "/api/oidc/login", nil))
+	if w.Code != 503 {
+		t.Fatalf("status %d, want 503", w.Code)
+	}
+}
@@ -0,0 +1,244 @@
+package server
+
+import (
+	"bwrs/tools"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"k8s.io/klog"
+)
+
+/*
+Rate limiting
+Token buckets are kept in memory per client IP and per username or ask key,
+the login endpoint additionally locks a username for the client IP that repeatedly failed.
+*/
+
+const (
+	defaultIPRate           = 5
+	defaultIPBurst          = 20
+	defaultKeyRate          = 2
+	defaultKeyBurst         = 10
+	defaultMaxLoginFailures = 5
+	defaultLockoutDuration  = 15 * time.Minute
+)
+
+// rateLimitSettings the configured values with defaults applied
+func rateLimitSettings() tools.RateLimitConfig {
+	rl := currentConfig().RateLimit
+	if rl.IPRate <= 0 {
+		rl.IPRate = defaultIPRate
+	}
+	if rl.IPBurst <= 0 {
+		rl.IPBurst = defaultIPBurst
+	}
+	if rl.KeyRate <= 0 {
+		rl.KeyRate = defaultKeyRate
+	}
+	if rl.KeyBurst <= 0 {
+		rl.KeyBurst = defaultKeyBurst
+	}
+	if rl.MaxLoginFailures <= 0 {
+		rl.MaxLoginFailures = defaultMaxLoginFailures
+	}
+	return rl
+}
+
+func lockoutDuration() time.Duration {
+	if d, err := time.ParseDuration(currentConfig().RateLimit.LockoutDuration); err == nil && d > 0 {
+		return d
+	}
+	return defaultLockoutDuration
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var rateBuckets = struct {
+	mu    sync.Mutex
+	m     map[string]*tokenBucket
+	swept time.Time
+}{
+	m: make(map[string]*tokenBucket),
+}
+
+// takeToken reports whether the bucket of key has a token left and how long to wait otherwise
+func takeToken(key string, rate float64, burst int) (bool, time.Duration) {
+	now := time.Now()
+	rateBuckets.mu.Lock()
+	defer rateBuckets.mu.Unlock()
+	// drop idle buckets, they are full again anyway
+	if now.Sub(rateBuckets.swept) > time.Minute {
+		for k, b := range rateBuckets.m {
+			if now.Sub(b.last) > 10*time.Minute {
+				delete(rateBuckets.m, k)
+			}
+		}
+		rateBuckets.swept = now
+	}
+	b, ok := rateBuckets.m[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		rateBuckets.m[key] = b
+	}
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+/*
+RateLimit
+Limits requests per client IP and, when keyFn returns a non-empty value,
+per username or ask key, answering 429 with Retry-After when a bucket is empty.
+*/
+func RateLimit(keyFn func(c *gin.Context) string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rl := rateLimitSettings()
+		ok, wait := takeToken("ip:"+c.ClientIP(), rl.IPRate, rl.IPBurst)
+		if ok && keyFn != nil {
+			if key := keyFn(c); key != "" {
+				ok, wait = takeToken("key:"+key, rl.KeyRate, rl.KeyBurst)
+			}
+		}
+		if !ok {
+			c.Header("Retry-After", fmt.Sprintf("%d", int(math.Ceil(wait.Seconds()))))
+			c.JSON(429, gin.H{"status": "false", "error": "too many requests"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+func loginRateKey(c *gin.Context) string {
+	if u := c.PostForm("username"); u != "" {
+		return "user:" + u
+	}
+	return ""
+}
+
+// askRateKey buckets by the digest of the key so the secret itself is not kept in memory
+func askRateKey(c *gin.Context) string {
+	if ask := askFromRequest(c); ask != "" {
+		sum := sha256.Sum256([]byte(ask))
+		return "ask:" + hex.EncodeToString(sum[:])
+	}
+	return ""
+}
+
+type LockoutEvent struct {
+	Time     string `json:"time"`
+	Username string `json:"username"`
+	IP       string `json:"ip"`
+	Until    string `json:"until"`
+}
+
+// loginKey failures are counted per username and client IP, so failures from one address
+// cannot lock the user out from another
+type loginKey struct {
+	username string
+	ip       string
+}
+
+// loginFailure count only covers failures less than one lockout duration apart
+type loginFailure struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+var loginGuard = struct {
+	mu       sync.Mutex
+	failures map[loginKey]*loginFailure
+	events   []LockoutEvent
+	swept    time.Time
+}{
+	failures: make(map[loginKey]*loginFailure),
+	events:   make([]LockoutEvent, 0, 50),
+}
+
+// loginLocked returns the remaining lockout of a username for the client IP
+func loginLocked(username string, ip string) time.Duration {
+	loginGuard.mu.Lock()
+	defer loginGuard.mu.Unlock()
+	f, ok := loginGuard.failures[loginKey{username, ip}]
+	if !ok {
+		return 0
+	}
+	if left := time.Until(f.lockedUntil); left > 0 {
+		return left
+	}
+	return 0
+}
+
+// loginFailed counts a failed attempt and locks the username for ip once the limit is reached
+func loginFailed(username string, ip string) {
+	maxFailures := rateLimitSettings().MaxLoginFailures
+	window := lockoutDuration()
+	now := time.Now()
+	loginGuard.mu.Lock()
+	defer loginGuard.mu.Unlock()
+	// unknown usernames are counted too, so drop entries that can no longer lock anything
+	if now.Sub(loginGuard.swept) > time.Minute {
+		for key, f := range loginGuard.failures {
+			if now.After(f.lockedUntil) && now.Sub(f.last) > window {
+				delete(loginGuard.failures, key)
+			}
+		}
+		loginGuard.swept = now
+	}
+	key := loginKey{username, ip}
+	f, ok := loginGuard.failures[key]
+	if !ok {
+		f = &loginFailure{}
+		loginGuard.failures[key] = f
+	}
+	// an expired lockout or an old failure starts a new round of attempts
+	if (!f.lockedUntil.IsZero() && now.After(f.lockedUntil)) || now.Sub(f.last) > window {
+		f.count = 0
+		f.lockedUntil = time.Time{}
+	}
+	f.last = now
+	f.count++
+	if f.count < maxFailures {
+		return
+	}
+	f.lockedUntil = now.Add(window)
+	ev := LockoutEvent{
+		Time:     now.Format("2006-01-02 15:04:05"),
+		Username: username,
+		IP:       ip,
+		Until:    f.lockedUntil.Format("2006-01-02 15:04:05"),
+	}
+	loginGuard.events = append(loginGuard.events, ev)
+	if len(loginGuard.events) > 50 {
+		loginGuard.events = loginGuard.events[len(loginGuard.events)-50:]
+	}
+	klog.Warningf("login locked for %q from %s until %s after %d failures", username, ip, ev.Until, f.count)
+}
+
+func loginSucceeded(username string, ip string) {
+	loginGuard.mu.Lock()
+	delete(loginGuard.failures, loginKey{username, ip})
+	loginGuard.mu.Unlock()
+}
+
+// lockoutEvents recent lockouts, newest last
+func lockoutEvents() []LockoutEvent {
+	loginGuard.mu.Lock()
+	defer loginGuard.mu.Unlock()
+	out := make([]LockoutEvent, len(loginGuard.events))
+	copy(out, loginGuard.events)
+	return out
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"bwrs/databases"
+	"bwrs/tools"
+	"context"
+	"errors"
+	"flag"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/gin-gonic/gin"
+	"k8s.io/klog"
+)
+
+/*
+Config reload
+SIGHUP or POST /api/config/reload re-reads the config file with the same
+environment and command line overrides as at startup. An invalid file is
+rejected as a whole and the running config is kept. Settings that are only read
+at startup keep their running value and are reported until the next restart,
+everything else is swapped in at once.
+*/
+
+// restartSettings yaml paths read once at startup, a trailing dot matches the whole section
+var restartSettings = []string{
+	"port",
+	"server.readHeaderTimeout",
+	"server.readTimeout",
+	"server.writeTimeout",
+	"server.idleTimeout",
+	"database.",
+	"tls.",
+	"session.trustedProxies",
+	"downloadVerify.",
+}
+
+func requiresRestart(path string) bool {
+	for _, s := range restartSettings {
+		if path == s || (strings.HasSuffix(s, ".") && strings.HasPrefix(path, s)) {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadResult Applied and RestartRequired hold yaml paths, Problems the validation errors
+type reloadResult struct {
+	Applied         []string `json:"applied"`
+	RestartRequired []string `json:"restartRequired"`
+	Problems        []string `json:"problems"`
+}
+
+// errInvalidConfig the reloaded file has validation problems, nothing was applied
+var errInvalidConfig = errors.New("invalid config, nothing was applied")
+
+// reloadMu serializes reloads so two of them cannot interleave their diffs
+var reloadMu sync.Mutex
+
+func reloadConfig(ctx context.Context, database databases.Databases) (reloadResult, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	res := reloadResult{Applied: []string{}, RestartRequired: []string{}, Problems: []string{}}
+	next, err := loadConfig(configFilePath)
+	if err != nil {
+		return res, err
+	}
+	if problems := validateConfig(next); len(problems) > 0 {
+		for _, p := range problems {
+			res.Problems = append(res.Problems, p.String())
+		}
+		return res, errInvalidConfig
+	}
+	if next.TLS.SelfSigned && (next.TLS.CertFile == "" || next.TLS.KeyFile == "") {
+		next.TLS.CertFile, next.TLS.KeyFile = defaultTLSFiles(configFilePath)
+	}
+
+	current := currentConfig()
+	for _, path := range tools.ChangedConfigFields(current, next) {
+		if requiresRestart(path) {
+			tools.CopyConfigField(&next, current, path)
+			res.RestartRequired = append(res.RestartRequired, path)
+		} else {
+			res.Applied = append(res.Applied, path)
+		}
+	}
+	setServiceConfig(next)
+
+	if next.Log.Verbosity != current.Log.Verbosity {
+		applyLogVerbosity(next.Log.Verbosity)
+	}
+	if next.Login.User != current.Login.User {
+		ensureConfigUser(ctx, database, next.Login.User)
+	}
+	klog.Infof("config reloaded, applied %v, restart required for %v", res.Applied, res.RestartRequired)
+	return res, nil
+}
+
+// startupVerbosity the klog level given with --v, restored when log.verbosity is cleared
+var startupVerbosity = "0"
+
+// applyLogVerbosity sets the klog level, an empty value goes back to the --v flag
+func applyLogVerbosity(verbosity string) {
+	if verbosity == "" {
+		verbosity = startupVerbosity
+	}
+	if err := flag.Set("v", verbosity); err != nil {
+		klog.Warningf("invalid log.verbosity %q: %v", verbosity, err)
+	}
+}
+
+// watchReloadSignal reloads the config on every SIGHUP until shutdown
+func watchReloadSignal(database databases.Databases) {
+	goBackground(func(ctx context.Context) {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGHUP)
+		defer signal.Stop(sigCh)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sigCh:
+				res, err := reloadConfig(ctx, database)
+				if err != nil {
+					klog.Errorf("reload %s failed: %v", configFilePath, err)
+					for _, p := range res.Problems {
+						klog.Errorf("  %s", p)
+					}
+				}
+			}
+		}
+	})
+}
+
+func ConfigReload(c *gin.Context, database databases.Databases) {
+	res, err := reloadConfig(c.Request.Context(), database)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error(), "problems": res.Problems})
+		return
+	}
+	c.JSON(200, res)
+}
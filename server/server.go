@@ -2,11 +2,15 @@ package server
 
 import (
 	"bwrs/databases"
+	"bwrs/tools"
+	"context"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/hex"
 	"fmt"
 	"io/fs"
 	"mime"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -25,6 +29,10 @@ This is the function that implements all interfaces of gin
 type Session struct {
 	UserID   int64
 	Username string
+	Role     string
+	CSRF     string
+	// APIToken the request was authenticated by a Bearer API token instead of the session cookie
+	APIToken bool
 }
 
 var sessionStore = struct {
@@ -34,6 +42,23 @@ var sessionStore = struct {
 	m: make(map[string]Session),
 }
 
+var serviceConfig = struct {
+	mu sync.RWMutex
+	c  tools.ServiceConfig
+}{}
+
+func setServiceConfig(config tools.ServiceConfig) {
+	serviceConfig.mu.Lock()
+	serviceConfig.c = config
+	serviceConfig.mu.Unlock()
+}
+
+func currentConfig() tools.ServiceConfig {
+	serviceConfig.mu.RLock()
+	defer serviceConfig.mu.RUnlock()
+	return serviceConfig.c
+}
+
 type RequestRecord struct {
 	Time   string
 	Method string
@@ -62,7 +87,7 @@ func TrackMetrics() gin.HandlerFunc {
 		if path == "" {
 			path = c.Request.URL.Path
 		}
-		if !(path == "/api/server/save" || path == "/api/server/duplicate") {
+		if !isTrackedPath(path) {
 			return
 		}
 		method := c.Request.Method
@@ -70,13 +95,13 @@ func TrackMetrics() gin.HandlerFunc {
 		params := map[string]string{}
 		for k, v := range c.Request.URL.Query() {
 			if len(v) > 0 {
-				params[k] = v[0]
+				params[k] = redactParam(k, v[0])
 			}
 		}
 		_ = c.Request.ParseForm()
 		for k, v := range c.Request.PostForm {
 			if len(v) > 0 {
-				params[k] = v[0]
+				params[k] = redactParam(k, v[0])
 			}
 		}
 		metrics.mu.Lock()
@@ -97,8 +122,24 @@ func TrackMetrics() gin.HandlerFunc {
 	}
 }
 
-func initEnvironment(str string) {
-	klog.Info(str)
+// secretParams are never kept in the request records
+var secretParams = map[string]bool{
+	"ask":      true,
+	"password": true,
+	"token":    true,
+	"secret":   true,
+}
+
+func redactParam(key string, value string) string {
+	if secretParams[strings.ToLower(key)] && value != "" {
+		return "***"
+	}
+	return value
+}
+
+// isTrackedPath the ask key protected downloader endpoints are recorded in metrics
+func isTrackedPath(path string) bool {
+	return strings.HasPrefix(path, "/api/server/")
 }
 
 func Test(c *gin.Context, database databases.Databases) {
@@ -112,24 +153,85 @@ func Login(c *gin.Context, database databases.Databases) {
 		c.JSON(400, gin.H{"error": "missing credentials"})
 		return
 	}
-	u, err := database.GetUserByUsername(username)
+	if left := loginLocked(username, c.ClientIP()); left > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(left.Seconds())+1))
+		c.JSON(429, gin.H{"error": "too many failed logins, try again later"})
+		return
+	}
+	u, err := database.GetUserByUsername(c.Request.Context(), username)
 	if err != nil || u == nil {
+		loginFailed(username, c.ClientIP())
 		c.JSON(401, gin.H{"error": "invalid credentials"})
 		return
 	}
-	if u.Password != password {
+	ok, legacy := databases.CheckPassword(u.Password, password)
+	if !ok {
+		loginFailed(username, c.ClientIP())
 		c.JSON(401, gin.H{"error": "invalid credentials"})
 		return
 	}
+	loginSucceeded(username, c.ClientIP())
+	if legacy {
+		// plaintext password of an older version, store the hash now that we know it
+		if err := database.SetUserPassword(c.Request.Context(), u.Id, password); err != nil {
+			klog.Warningf("hash password of %s failed: %v", u.Username, err)
+		}
+	}
+	if u.Disabled {
+		c.JSON(403, gin.H{"error": "account disabled"})
+		return
+	}
+	startSession(c, database, u)
+	c.JSON(200, gin.H{"ok": true})
+}
+
+// sessionMaxAge lifetime of the session cookies in seconds
+const sessionMaxAge = 3600
+
+func randomToken() string {
 	buf := make([]byte, 32)
 	_, _ = rand.Read(buf)
-	token := hex.EncodeToString(buf)
-	_ = database.SetUserToken(u.Id, token)
+	return hex.EncodeToString(buf)
+}
+
+/*
+startSession
+Creates the session of a logged in user and sets two cookies: session_token (HttpOnly)
+and csrf_token, which the frontend reads and sends back in the X-CSRF-Token header.
+*/
+func startSession(c *gin.Context, database databases.Databases, u *databases.UserLogin) {
+	token := randomToken()
+	csrf := randomToken()
+	_ = database.SetUserToken(c.Request.Context(), u.Id, token)
 	sessionStore.mu.Lock()
-	sessionStore.m[token] = Session{UserID: u.Id, Username: u.Username}
+	sessionStore.m[token] = Session{UserID: u.Id, Username: u.Username, Role: u.Role, CSRF: csrf}
 	sessionStore.mu.Unlock()
-	c.SetCookie("session_token", token, 3600, "/", "", false, true)
-	c.JSON(200, gin.H{"ok": true})
+	secure := secureCookies(c)
+	c.SetSameSite(cookieSameSite())
+	c.SetCookie("session_token", token, sessionMaxAge, "/", "", secure, true)
+	c.SetCookie("csrf_token", csrf, sessionMaxAge, "/", "", secure, false)
+}
+
+func cookieSameSite() http.SameSite {
+	if strings.EqualFold(currentConfig().Session.SameSite, "strict") {
+		return http.SameSiteStrictMode
+	}
+	return http.SameSiteLaxMode
+}
+
+// secureCookies served over TLS or behind a reverse proxy terminating HTTPS
+func secureCookies(c *gin.Context) bool {
+	return c.Request.TLS != nil || currentConfig().Session.BehindHTTPSProxy
+}
+
+// checkCSRF cookie authenticated requests that change state must echo the session CSRF token
+func checkCSRF(c *gin.Context, sess Session) bool {
+	switch c.Request.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	token := c.GetHeader("X-CSRF-Token")
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(sess.CSRF)) == 1
 }
 
 func AuthRequired() gin.HandlerFunc {
@@ -141,19 +243,36 @@ func AuthRequired() gin.HandlerFunc {
 			return
 		}
 		sessionStore.mu.Lock()
-		_, ok := sessionStore.m[token]
+		sess, ok := sessionStore.m[token]
 		sessionStore.mu.Unlock()
 		if !ok {
 			c.Redirect(302, "/login")
 			c.Abort()
 			return
 		}
+		c.Set("session", sess)
 		c.Next()
 	}
 }
 
-func AuthRequiredAPI() gin.HandlerFunc {
+/*
+AuthRequiredAPI
+Accepts a personal API token in "Authorization: Bearer <token>" or the session cookie,
+cookie authenticated writes must also carry the CSRF token.
+*/
+func AuthRequiredAPI(database databases.Databases) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if bearer, ok := bearerToken(c); ok {
+			sess, ok := apiTokenSession(c.Request.Context(), database, bearer)
+			if !ok {
+				c.JSON(401, gin.H{"error": "invalid token"})
+				c.Abort()
+				return
+			}
+			c.Set("session", sess)
+			c.Next()
+			return
+		}
 		token, err := c.Cookie("session_token")
 		if err != nil || token == "" {
 			c.JSON(401, gin.H{"error": "unauthenticated"})
@@ -161,19 +280,135 @@ func AuthRequiredAPI() gin.HandlerFunc {
 			return
 		}
 		sessionStore.mu.Lock()
-		_, ok := sessionStore.m[token]
+		sess, ok := sessionStore.m[token]
 		sessionStore.mu.Unlock()
 		if !ok {
 			c.JSON(401, gin.H{"error": "unauthenticated"})
 			c.Abort()
 			return
 		}
+		if !checkCSRF(c, sess) {
+			c.JSON(403, gin.H{"error": "invalid csrf token"})
+			c.Abort()
+			return
+		}
+		c.Set("session", sess)
+		c.Next()
+	}
+}
+
+// bearerToken the value of "Authorization: Bearer <token>"
+func bearerToken(c *gin.Context) (string, bool) {
+	scheme, value, ok := strings.Cut(strings.TrimSpace(c.GetHeader("Authorization")), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	value = strings.TrimSpace(value)
+	return value, value != ""
+}
+
+// apiTokenSession a request scoped session for a valid token of an enabled user
+func apiTokenSession(ctx context.Context, database databases.Databases, token string) (Session, bool) {
+	t, err := database.LookupAPIToken(ctx, token)
+	if err != nil {
+		klog.Warningf("lookup api token failed: %v", err)
+		return Session{}, false
+	}
+	if t == nil || t.Disabled {
+		return Session{}, false
+	}
+	return Session{UserID: t.UserId, Username: t.Username, Role: t.Role, APIToken: true}, true
+}
+
+// user roles, every role may do what the roles below it can
+const (
+	roleAdmin  = "admin"
+	roleEditor = "editor"
+	roleViewer = "viewer"
+)
+
+var roleRank = map[string]int{
+	roleViewer: 1,
+	roleEditor: 2,
+	roleAdmin:  3,
+}
+
+// currentSession the session stored by AuthRequiredAPI
+func currentSession(c *gin.Context) (Session, bool) {
+	v, ok := c.Get("session")
+	if !ok {
+		return Session{}, false
+	}
+	sess, ok := v.(Session)
+	return sess, ok
+}
+
+/*
+RequireRole
+Must run after AuthRequiredAPI, viewers may read everything,
+editors change content and admins also manage users, ask keys and settings.
+*/
+func RequireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sess, ok := currentSession(c)
+		if !ok || roleRank[sess.Role] < roleRank[role] {
+			c.JSON(403, gin.H{"error": "forbidden"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireCookieSession rejects requests authenticated by an API token, so a leaked token cannot mint new ones
+func RequireCookieSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if sess, ok := currentSession(c); !ok || sess.APIToken {
+			c.JSON(403, gin.H{"error": "requires a login session, not an API token"})
+			c.Abort()
+			return
+		}
 		c.Next()
 	}
 }
 
+// canModify admins may change everything, other users only what they own,
+// records without owner (created before multi-user support) belong to admins
+func canModify(c *gin.Context, ownerID int64) bool {
+	sess, ok := currentSession(c)
+	if !ok {
+		return false
+	}
+	if sess.Role == roleAdmin {
+		return true
+	}
+	return ownerID > 0 && ownerID == sess.UserID
+}
+
+// sessionUserID the id of the logged in user, 0 without session
+func sessionUserID(c *gin.Context) int64 {
+	sess, _ := currentSession(c)
+	return sess.UserID
+}
+
+// updateUserSessions applies fn to every session of a user, sessions for which fn returns false are dropped
+func updateUserSessions(userID int64, fn func(sess *Session) bool) {
+	sessionStore.mu.Lock()
+	defer sessionStore.mu.Unlock()
+	for token, sess := range sessionStore.m {
+		if sess.UserID != userID {
+			continue
+		}
+		if !fn(&sess) {
+			delete(sessionStore.m, token)
+			continue
+		}
+		sessionStore.m[token] = sess
+	}
+}
+
 func ButtonsList(c *gin.Context, database databases.Databases) {
-	list, err := database.ListButtons()
+	list, err := database.ListButtons(c.Request.Context())
 	if err != nil {
 		c.JSON(500, gin.H{"error": "list failed"})
 		return
@@ -189,7 +424,7 @@ func ButtonsAdd(c *gin.Context, database databases.Databases) {
 		c.JSON(400, gin.H{"error": "missing fields"})
 		return
 	}
-	if err := database.AddButton(name, url, typ); err != nil {
+	if err := database.AddButton(c.Request.Context(), name, url, typ); err != nil {
 		c.JSON(500, gin.H{"error": "add failed"})
 		return
 	}
@@ -203,7 +438,7 @@ func ButtonsDelete(c *gin.Context, database databases.Databases) {
 		c.JSON(400, gin.H{"error": "invalid id"})
 		return
 	}
-	if err := database.DeleteButton(id); err != nil {
+	if err := database.DeleteButton(c.Request.Context(), id); err != nil {
 		c.JSON(500, gin.H{"error": "delete failed"})
 		return
 	}
@@ -211,8 +446,8 @@ func ButtonsDelete(c *gin.Context, database databases.Databases) {
 }
 
 func Dashboard(c *gin.Context, database databases.Databases) {
-	meta, _ := database.DatabaseMeta()
-	tables, _ := database.ListTables()
+	meta, _ := database.DatabaseMeta(c.Request.Context())
+	tables, _ := database.ListTables(c.Request.Context())
 	proto := c.Request.Header.Get("X-Forwarded-Proto")
 	if proto == "" {
 		if c.Request.TLS != nil {
@@ -228,13 +463,13 @@ func Dashboard(c *gin.Context, database databases.Databases) {
 	uptime := int(time.Since(metrics.start).Seconds())
 	counters := make([]gin.H, 0, len(metrics.counters))
 	for k, v := range metrics.counters {
-		if strings.HasSuffix(k, " /api/server/save") || strings.HasSuffix(k, " /api/server/duplicate") {
+		if _, p, _ := strings.Cut(k, " "); isTrackedPath(p) {
 			counters = append(counters, gin.H{"name": k, "count": v})
 		}
 	}
 	recent := make([]gin.H, 0, len(metrics.records))
 	for _, r := range metrics.records {
-		if r.Path == "/api/server/save" || r.Path == "/api/server/duplicate" {
+		if isTrackedPath(r.Path) {
 			recent = append(recent, gin.H{
 				"time":   r.Time,
 				"method": r.Method,
@@ -267,6 +502,7 @@ func Dashboard(c *gin.Context, database databases.Databases) {
 		},
 		"interfaces": counters,
 		"requests":   recent,
+		"lockouts":   lockoutEvents(),
 	})
 }
 
@@ -321,7 +557,7 @@ func LocalIndex(c *gin.Context, database databases.Databases) {
 		}
 	}
 	table := "local_index_" + tableBase
-	_ = database.CreateLocalIndexTable(table)
+	_ = database.CreateLocalIndexTable(c.Request.Context(), table)
 	var items []databases.LocalEntry
 	_ = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
 		if err != nil {
@@ -343,15 +579,19 @@ func LocalIndex(c *gin.Context, database databases.Databases) {
 		})
 		return nil
 	})
-	if err := database.SaveLocalIndexEntries(table, items); err != nil {
+	if err := database.SaveLocalIndexEntries(c.Request.Context(), table, items); err != nil {
 		c.JSON(500, gin.H{"error": "save failed"})
 		return
 	}
-	if err := database.UpsertLocalIndexBinding(table, displayName, desc); err != nil {
+	if err := database.UpsertLocalIndexBinding(c.Request.Context(), table, displayName, desc); err != nil {
 		c.JSON(500, gin.H{"error": "bind failed"})
 		return
 	}
-	c.JSON(200, gin.H{"ok": true, "table": table, "count": len(items)})
+	tagged, err := applyAutoTags(c.Request.Context(), database, loadAutoTagMatchers(c.Request.Context(), database), items)
+	if err != nil {
+		klog.Warningf("auto tag %s failed: %v", table, err)
+	}
+	c.JSON(200, gin.H{"ok": true, "table": table, "count": len(items), "tagged": tagged})
 }
 
 func LocalFile(c *gin.Context, database databases.Databases) {
@@ -376,7 +616,7 @@ func LocalFile(c *gin.Context, database databases.Databases) {
 
 func TagsSearch(c *gin.Context, database databases.Databases) {
 	q := c.Query("q")
-	list, _ := database.SearchTags(q)
+	list, _ := database.SearchTags(c.Request.Context(), q)
 	c.JSON(200, gin.H{"items": list})
 }
 
@@ -386,7 +626,7 @@ func TagsAdd(c *gin.Context, database databases.Databases) {
 		c.JSON(400, gin.H{"error": "missing name"})
 		return
 	}
-	if err := database.AddTag(name); err != nil {
+	if err := database.AddTag(c.Request.Context(), name); err != nil {
 		c.JSON(500, gin.H{"error": "add failed"})
 		return
 	}
@@ -394,7 +634,7 @@ func TagsAdd(c *gin.Context, database databases.Databases) {
 }
 
 func TagsAll(c *gin.Context, database databases.Databases) {
-	list, _ := database.ListAllTags()
+	list, _ := database.ListAllTags(c.Request.Context())
 	c.JSON(200, gin.H{"items": list})
 }
 
@@ -408,7 +648,16 @@ func FavoriteSave(c *gin.Context, database databases.Databases) {
 		c.JSON(400, gin.H{"error": "missing fields"})
 		return
 	}
-	if err := database.UpsertFavorite(path, orig, fav, desc); err != nil {
+	owners, err := database.FavoriteOwners(c.Request.Context(), []string{databases.DirHash(path)})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "save favorite failed"})
+		return
+	}
+	if owner, ok := owners[databases.DirHash(path)]; ok && !canModify(c, owner) {
+		c.JSON(403, gin.H{"error": "favorite owned by another user"})
+		return
+	}
+	if err := database.UpsertFavorite(c.Request.Context(), path, orig, fav, desc, sessionUserID(c)); err != nil {
 		c.JSON(500, gin.H{"error": "save favorite failed"})
 		return
 	}
@@ -419,7 +668,7 @@ func FavoriteSave(c *gin.Context, database databases.Databases) {
 			tags = append(tags, ss)
 		}
 	}
-	if err := database.SetDirectoryTags(path, tags); err != nil {
+	if err := database.SetDirectoryTags(c.Request.Context(), path, tags); err != nil {
 		c.JSON(500, gin.H{"error": "set tags failed"})
 		return
 	}
@@ -450,18 +699,112 @@ func FavoritesList(c *gin.Context, database databases.Databases) {
 			}
 		}
 	}
-	items, total, err := database.ListFavorites(q, page, pageSize, tags)
+	var ownerID int64
+	if c.Query("mine") == "1" {
+		ownerID = sessionUserID(c)
+	}
+	items, total, err := database.ListFavorites(c.Request.Context(), q, page, pageSize, tags, ownerID)
 	if err != nil {
 		c.JSON(500, gin.H{"error": "list failed"})
 		return
 	}
 	c.JSON(200, gin.H{"items": items, "total": total, "page": page, "pageSize": pageSize})
 }
+
+func isDirHash(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// checkFavoriteOwners rejects the request when one of the existing favorites may not be changed by the user
+func checkFavoriteOwners(c *gin.Context, database databases.Databases, hashes []string) bool {
+	owners, err := database.FavoriteOwners(c.Request.Context(), hashes)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "lookup failed"})
+		return false
+	}
+	for hash, owner := range owners {
+		if !canModify(c, owner) {
+			c.JSON(403, gin.H{"error": "favorite owned by another user", "hash": hash})
+			return false
+		}
+	}
+	return true
+}
+
+func FavoriteDelete(c *gin.Context, database databases.Databases) {
+	hash := strings.ToLower(c.Param("hash"))
+	if !isDirHash(hash) {
+		c.JSON(400, gin.H{"error": "invalid hash"})
+		return
+	}
+	if !checkFavoriteOwners(c, database, []string{hash}) {
+		return
+	}
+	n, err := database.DeleteFavorites(c.Request.Context(), []string{hash}, c.Query("tags") == "1")
+	if err != nil {
+		c.JSON(500, gin.H{"error": "delete failed"})
+		return
+	}
+	if n == 0 {
+		c.JSON(404, gin.H{"error": "not found"})
+		return
+	}
+	c.JSON(200, gin.H{"ok": true})
+}
+
+func FavoritesDelete(c *gin.Context, database databases.Databases) {
+	var hashes []string
+	for _, s := range strings.Split(c.PostForm("hashes"), ",") {
+		ss := strings.ToLower(strings.TrimSpace(s))
+		if ss == "" {
+			continue
+		}
+		if !isDirHash(ss) {
+			c.JSON(400, gin.H{"error": "invalid hash", "hash": ss})
+			return
+		}
+		hashes = append(hashes, ss)
+	}
+	if len(hashes) == 0 {
+		c.JSON(400, gin.H{"error": "missing hashes"})
+		return
+	}
+	if !checkFavoriteOwners(c, database, hashes) {
+		return
+	}
+	n, err := database.DeleteFavorites(c.Request.Context(), hashes, c.PostForm("tags") == "1")
+	if err != nil {
+		c.JSON(500, gin.H{"error": "delete failed"})
+		return
+	}
+	c.JSON(200, gin.H{"ok": true, "deleted": n})
+}
+
+// FavoriteExists accepts one or more path values, from the query string or a form post
+func FavoriteExists(c *gin.Context, database databases.Databases) {
+	paths := c.QueryArray("path")
+	paths = append(paths, c.PostFormArray("path")...)
+	if len(paths) == 0 {
+		c.JSON(400, gin.H{"error": "missing path"})
+		return
+	}
+	items, err := database.FavoritesExist(c.Request.Context(), paths)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "lookup failed"})
+		return
+	}
+	c.JSON(200, gin.H{"items": items})
+}
+
 func IndexesList(c *gin.Context, database databases.Databases) {
-	tables, _ := database.ListTables()
+	tables, _ := database.ListTables(c.Request.Context())
 	var bindings map[string]databases.LocalIndexBinding
 	bindings = make(map[string]databases.LocalIndexBinding)
-	if bl, err := database.ListLocalIndexBindings(); err == nil {
+	if bl, err := database.ListLocalIndexBindings(c.Request.Context()); err == nil {
 		for _, b := range bl {
 			bindings[b.TableName] = b
 		}
@@ -499,7 +842,7 @@ func IndexFiles(c *gin.Context, database databases.Databases) {
 		c.JSON(400, gin.H{"error": "missing table"})
 		return
 	}
-	items, total, err := database.ListLocalIndexEntries(table, offset, limit)
+	items, total, err := database.ListLocalIndexEntries(c.Request.Context(), table, offset, limit)
 	if err != nil {
 		c.JSON(500, gin.H{"error": "list files failed"})
 		return
@@ -518,7 +861,12 @@ func IndexSearch(c *gin.Context, database databases.Databases) {
 		c.JSON(400, gin.H{"error": "missing table"})
 		return
 	}
-	items, total, err := database.SearchLocalIndexEntries(table, q, offset, limit)
+	text, filter, err := parseSearchQuery(q)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	items, total, err := database.SearchLocalIndexEntries(c.Request.Context(), table, text, filter, offset, limit)
 	if err != nil {
 		c.JSON(500, gin.H{"error": "search failed"})
 		return
@@ -526,13 +874,62 @@ func IndexSearch(c *gin.Context, database databases.Databases) {
 	c.JSON(200, gin.H{"items": items, "total": total, "offset": offset, "limit": limit, "q": q})
 }
 
+var fileMetaColors = map[string]bool{
+	"red": true, "orange": true, "yellow": true, "green": true, "blue": true, "purple": true, "gray": true,
+}
+
+/*
+parseSearchQuery
+Splits filter tokens out of an index search query, the rest is the path keyword.
+Supported tokens: rating:>=4 rating:5 color:red note:word
+*/
+func parseSearchQuery(q string) (string, databases.FileMetaFilter, error) {
+	var filter databases.FileMetaFilter
+	var words []string
+	for _, tok := range strings.Fields(q) {
+		key, val, found := strings.Cut(tok, ":")
+		if !found {
+			words = append(words, tok)
+			continue
+		}
+		switch strings.ToLower(key) {
+		case "rating":
+			op := "="
+			for _, o := range []string{">=", "<=", "!=", ">", "<", "="} {
+				if strings.HasPrefix(val, o) {
+					op = o
+					val = strings.TrimPrefix(val, o)
+					break
+				}
+			}
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 || n > 5 {
+				return "", filter, fmt.Errorf("invalid rating filter")
+			}
+			filter.RatingOp = op
+			filter.Rating = n
+		case "color":
+			val = strings.ToLower(val)
+			if !fileMetaColors[val] {
+				return "", filter, fmt.Errorf("invalid color filter")
+			}
+			filter.Color = val
+		case "note":
+			filter.Note = val
+		default:
+			words = append(words, tok)
+		}
+	}
+	return strings.Join(words, " "), filter, nil
+}
+
 func IndexInfo(c *gin.Context, database databases.Databases) {
 	table := c.Query("table")
 	if table == "" {
 		c.JSON(400, gin.H{"error": "missing table"})
 		return
 	}
-	binding, _ := database.GetLocalIndexBinding(table)
+	binding, _ := database.GetLocalIndexBinding(c.Request.Context(), table)
 	if binding == nil {
 		binding = &databases.LocalIndexBinding{
 			TableName:   table,
@@ -541,28 +938,113 @@ func IndexInfo(c *gin.Context, database databases.Databases) {
 			CreatedAt:   "",
 		}
 	}
-	count, _ := database.CountLocalIndexEntries(table)
+	count, _ := database.CountLocalIndexEntries(c.Request.Context(), table)
 	c.JSON(200, gin.H{"binding": binding, "count": count})
 }
 
-func ServerDuplicate(c *gin.Context, database databases.Databases) {
-	ask := c.Query("ask")
+// legacyGetAllowed downloader.allowLegacyGet, true unless explicitly set to false
+func legacyGetAllowed() bool {
+	allow := currentConfig().Downloader.AllowLegacyGet
+	return allow == nil || *allow
+}
+
+/*
+askFromRequest
+The ask key is read from the X-Ask-Key header or from "Authorization: Ask <key>"
+(Bearer is accepted too), the ask query parameter only when legacy GET is allowed.
+*/
+func askFromRequest(c *gin.Context) string {
+	if ask := strings.TrimSpace(c.GetHeader("X-Ask-Key")); ask != "" {
+		return ask
+	}
+	if auth := strings.TrimSpace(c.GetHeader("Authorization")); auth != "" {
+		scheme, value, ok := strings.Cut(auth, " ")
+		if ok && (strings.EqualFold(scheme, "Ask") || strings.EqualFold(scheme, "Bearer")) {
+			return strings.TrimSpace(value)
+		}
+	}
+	if legacyGetAllowed() {
+		return c.Query("ask")
+	}
+	return ""
+}
+
+// ask key scopes, a key without scopes may call every downloader endpoint
+const (
+	askScopeDuplicate = "duplicate"
+	askScopeSave      = "save"
+)
+
+var askScopes = map[string]bool{
+	askScopeDuplicate: true,
+	askScopeSave:      true,
+}
+
+// checkAskParam validates the ask key and its scope for a downloader request, writing the error response itself.
+// A verified client certificate (tls.clientCAFile) whose OU grants the scope is accepted in place of an ask key.
+func checkAskParam(c *gin.Context, database databases.Databases, scope string) bool {
+	hasCert := clientCertName(c) != ""
+	if hasCert && clientCertAllows(c, scope) {
+		return true
+	}
+	if currentConfig().TLS.RequireClientCert {
+		if hasCert {
+			c.JSON(403, gin.H{"status": "false", "error": "client certificate not allowed for " + scope})
+		} else {
+			c.JSON(403, gin.H{"status": "false", "error": "client certificate required"})
+		}
+		return false
+	}
+	ask := askFromRequest(c)
 	if ask == "" {
 		c.JSON(400, gin.H{"status": "false", "error": "missing ask"})
-		return
+		return false
 	}
-	ok, err := database.CheckAsk(ask)
+	ok, err := database.CheckAsk(c.Request.Context(), ask, scope)
 	if err != nil || !ok {
 		c.JSON(403, gin.H{"status": "false", "error": "invalid ask"})
-		return
+		return false
 	}
-	name := c.Query("name")
-	if name == "" {
+	return true
+}
+
+// downloadRecordFromRequest reads the record from the JSON body, or from the query string of a legacy GET
+func downloadRecordFromRequest(c *gin.Context) (downloadSaveRecord, bool) {
+	var rec downloadSaveRecord
+	if c.Request.Method == "GET" {
+		if !legacyGetAllowed() {
+			c.JSON(405, gin.H{"status": "false", "error": "GET is disabled, use POST with a JSON body"})
+			return rec, false
+		}
+		rec = downloadSaveRecord{
+			Name:         c.Query("name"),
+			Group:        c.Query("group"),
+			Desc:         c.Query("desc"),
+			LocalAddress: c.Query("local_address"),
+			Type:         c.Query("type"),
+		}
+	} else if err := c.ShouldBindJSON(&rec); err != nil {
+		c.JSON(400, gin.H{"status": "false", "error": "invalid body"})
+		return rec, false
+	}
+	rec.Name = strings.TrimSpace(rec.Name)
+	if rec.Name == "" {
 		c.JSON(400, gin.H{"status": "false", "error": "missing name"})
+		return rec, false
+	}
+	setAuditTarget(c, "name", rec.Name)
+	return rec, true
+}
+
+func ServerDuplicate(c *gin.Context, database databases.Databases) {
+	if !checkAskParam(c, database, askScopeDuplicate) {
 		return
 	}
-	database.EnsureDownloadSaveTable()
-	row, err := database.GetDownloadSaveByName(name)
+	rec, ok := downloadRecordFromRequest(c)
+	if !ok {
+		return
+	}
+	row, err := database.GetDownloadSaveByName(c.Request.Context(), rec.Name)
 	if err != nil {
 		c.JSON(500, gin.H{"status": "false"})
 		return
@@ -570,89 +1052,1266 @@ func ServerDuplicate(c *gin.Context, database databases.Databases) {
 	if row != nil {
 		c.JSON(200, gin.H{
 			"status": "true",
-			"data": gin.H{
-				"id":            row.Id,
-				"group":         row.Group,
-				"name":          row.Name,
-				"desc":          row.Desc,
-				"local_address": row.LocalAddress,
-			},
+			"data":   downloadSaveData(*row),
 		})
 		return
 	}
 	c.JSON(200, gin.H{"status": "false"})
 }
 
-func ServerSave(c *gin.Context, database databases.Databases) {
-	ask := c.Query("ask")
-	if ask == "" {
-		c.JSON(400, gin.H{"status": "false", "error": "missing ask"})
-		return
+// downloadSaveData the row format returned to downloader clients
+func downloadSaveData(row databases.DownloadSave) gin.H {
+	return gin.H{
+		"id":            row.Id,
+		"group":         row.Group,
+		"name":          row.Name,
+		"desc":          row.Desc,
+		"local_address": row.LocalAddress,
+		"type":          row.Type,
 	}
-	ok, err := database.CheckAsk(ask)
-	if err != nil || !ok {
-		c.JSON(403, gin.H{"status": "false", "error": "invalid ask"})
+}
+
+func ServerSave(c *gin.Context, database databases.Databases) {
+	if !checkAskParam(c, database, askScopeSave) {
 		return
 	}
-	name := c.Query("name")
-	group := c.Query("group")
-	desc := c.Query("desc")
-	local := c.Query("local_address")
-	if name == "" {
-		c.JSON(400, gin.H{"status": "false", "error": "missing name"})
+	rec, ok := downloadRecordFromRequest(c)
+	if !ok {
 		return
 	}
-	database.EnsureDownloadSaveTable()
-	exist, err := database.GetDownloadSaveByName(name)
+	exist, err := database.GetDownloadSaveByName(c.Request.Context(), rec.Name)
 	if err != nil {
 		c.JSON(500, gin.H{"status": "false"})
 		return
 	}
 	if exist != nil {
-		c.JSON(200, gin.H{"status": "false", "data": gin.H{
-			"id":            exist.Id,
-			"group":         exist.Group,
-			"name":          exist.Name,
-			"desc":          exist.Desc,
-			"local_address": exist.LocalAddress,
-		}})
+		c.JSON(200, gin.H{"status": "false", "data": downloadSaveData(*exist)})
 		return
 	}
-	if _, err := database.InsertDownloadSave(name, group, desc, local); err != nil {
+	if _, err := database.InsertDownloadSave(c.Request.Context(), rec.Name, rec.Group, rec.Desc, rec.LocalAddress, rec.Type); err != nil {
 		c.JSON(200, gin.H{"status": "false"})
 		return
 	}
 	c.JSON(200, gin.H{"status": "true"})
 }
 
-func AskList(c *gin.Context, database databases.Databases) {
-	items, err := database.ListAsk()
+func DownloadsList(c *gin.Context, database databases.Databases) {
+	page := 1
+	pageSize := 20
+	if p := c.Query("page"); p != "" {
+		if v, err := strconv.Atoi(p); err == nil && v > 0 {
+			page = v
+		}
+	}
+	if s := c.Query("pageSize"); s != "" {
+		// same bound as ListDownloadSaves, so the reported page size matches the items
+		if v, err := strconv.Atoi(s); err == nil && v > 0 && v <= 200 {
+			pageSize = v
+		}
+	}
+	items, total, err := database.ListDownloadSaves(c.Request.Context(), c.Query("q"), c.Query("group"), page, pageSize)
 	if err != nil {
 		c.JSON(500, gin.H{"error": "list failed"})
 		return
 	}
-	c.JSON(200, gin.H{"items": items})
+	c.JSON(200, gin.H{"items": items, "total": total, "page": page, "pageSize": pageSize})
 }
 
-func AskCreate(c *gin.Context, database databases.Databases) {
-	key, err := database.CreateAsk()
+// downloadFromParam loads the downloadsave row named by the :id route param, writing the error response itself
+func downloadFromParam(c *gin.Context, database databases.Databases) *databases.DownloadSave {
+	id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+	if id <= 0 {
+		c.JSON(400, gin.H{"error": "invalid id"})
+		return nil
+	}
+	row, err := database.GetDownloadSave(c.Request.Context(), id)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "create failed"})
+		c.JSON(500, gin.H{"error": "get failed"})
+		return nil
+	}
+	if row == nil {
+		c.JSON(404, gin.H{"error": "not found"})
+		return nil
+	}
+	return row
+}
+
+func DownloadGet(c *gin.Context, database databases.Databases) {
+	row := downloadFromParam(c, database)
+	if row == nil {
 		return
 	}
-	c.JSON(200, gin.H{"id": key.Id, "ask": key.Ask})
+	c.JSON(200, gin.H{"item": row})
 }
 
-func AskDelete(c *gin.Context, database databases.Databases) {
-	idStr := c.Param("id")
-	id, _ := strconv.ParseInt(idStr, 10, 64)
-	if id <= 0 {
-		c.JSON(400, gin.H{"error": "invalid id"})
+// DownloadUpdate changes group, desc, local_address and type, omitted fields are kept
+func DownloadUpdate(c *gin.Context, database databases.Databases) {
+	row := downloadFromParam(c, database)
+	if row == nil {
+		return
+	}
+	group, desc, local, typ := row.Group, row.Desc, row.LocalAddress, row.Type
+	if v, ok := c.GetPostForm("group"); ok {
+		group = v
+	}
+	if v, ok := c.GetPostForm("type"); ok {
+		typ = v
+	}
+	if v, ok := c.GetPostForm("desc"); ok {
+		desc = v
+	}
+	if v, ok := c.GetPostForm("local_address"); ok {
+		local = v
+	}
+	if err := database.UpdateDownloadSave(c.Request.Context(), row.Id, group, desc, local, typ); err != nil {
+		c.JSON(500, gin.H{"error": "update failed"})
+		return
+	}
+	c.JSON(200, gin.H{"ok": true})
+}
+
+func DownloadDelete(c *gin.Context, database databases.Databases) {
+	row := downloadFromParam(c, database)
+	if row == nil {
 		return
 	}
-	if err := database.DeleteAsk(id); err != nil {
+	if err := database.DeleteDownloadSave(c.Request.Context(), row.Id); err != nil {
 		c.JSON(500, gin.H{"error": "delete failed"})
 		return
 	}
 	c.JSON(200, gin.H{"ok": true})
 }
+
+/*
+DownloadsRelocate
+Rewrites the local_address prefix (from -> to) of every row with the given type after a disk is moved.
+new_type optionally replaces the type, dryrun=1 only previews the changes.
+*/
+func DownloadsRelocate(c *gin.Context, database databases.Databases) {
+	typ := strings.TrimSpace(c.PostForm("type"))
+	from := strings.TrimSpace(c.PostForm("from"))
+	to := strings.TrimSpace(c.PostForm("to"))
+	if typ == "" || from == "" || to == "" {
+		c.JSON(400, gin.H{"error": "missing type, from or to"})
+		return
+	}
+	dryRun := c.PostForm("dryrun") == "1"
+	plan, err := database.RelocateDownloadSaves(c.Request.Context(), typ, from, to, strings.TrimSpace(c.PostForm("new_type")), dryRun)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "relocate failed"})
+		return
+	}
+	const maxItems = 500
+	items := plan
+	if len(items) > maxItems {
+		items = items[:maxItems]
+	}
+	if items == nil {
+		items = []databases.DownloadSaveRelocation{}
+	}
+	c.JSON(200, gin.H{"ok": true, "dryRun": dryRun, "count": len(plan), "items": items})
+}
+
+// DownloadsVerify starts a background check of every local_address
+func DownloadsVerify(c *gin.Context, database databases.Databases) {
+	if !startVerifyJob(database) {
+		c.JSON(409, gin.H{"error": "verification already running", "job": verifyJobStatus()})
+		return
+	}
+	c.JSON(200, gin.H{"ok": true, "job": verifyJobStatus()})
+}
+
+/*
+DownloadsVerifyReport
+Returns the job progress, the counts of the last check by status and a page
+of checked rows, status=missing lists the downloads to fetch again.
+*/
+func DownloadsVerifyReport(c *gin.Context, database databases.Databases) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("pageSize", "20"))
+	status := strings.TrimSpace(c.Query("status"))
+	counts, err := database.CountDownloadSaveChecks(c.Request.Context())
+	if err != nil {
+		c.JSON(500, gin.H{"error": "report failed"})
+		return
+	}
+	items, total, err := database.ListDownloadSaveChecks(c.Request.Context(), status, page, pageSize)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "report failed"})
+		return
+	}
+	if items == nil {
+		items = []databases.DownloadSaveCheck{}
+	}
+	c.JSON(200, gin.H{"job": verifyJobStatus(), "counts": counts, "items": items, "total": total})
+}
+
+func DownloadGroups(c *gin.Context, database databases.Databases) {
+	items, err := database.ListDownloadSaveGroups(c.Request.Context())
+	if err != nil {
+		c.JSON(500, gin.H{"error": "list failed"})
+		return
+	}
+	c.JSON(200, gin.H{"items": items})
+}
+
+// maxBatchItems limits the size of one batch request from the downloader
+const maxBatchItems = 5000
+
+type downloadSaveRecord struct {
+	Name         string `json:"name"`
+	Group        string `json:"group"`
+	Desc         string `json:"desc"`
+	LocalAddress string `json:"local_address"`
+	Type         string `json:"type"`
+}
+
+/*
+ServerDuplicateBatch
+Body is a JSON array of names, the existing rows are returned keyed by name
+and the names not found are listed in missing.
+*/
+func ServerDuplicateBatch(c *gin.Context, database databases.Databases) {
+	if !checkAskParam(c, database, askScopeDuplicate) {
+		return
+	}
+	var names []string
+	if err := c.ShouldBindJSON(&names); err != nil {
+		c.JSON(400, gin.H{"status": "false", "error": "invalid body"})
+		return
+	}
+	if len(names) == 0 || len(names) > maxBatchItems {
+		c.JSON(400, gin.H{"status": "false", "error": fmt.Sprintf("expect 1 to %d names", maxBatchItems)})
+		return
+	}
+	setAuditTarget(c, "names", strings.Join(names, ","))
+	rows, err := database.GetDownloadSavesByNames(c.Request.Context(), names)
+	if err != nil {
+		c.JSON(500, gin.H{"status": "false"})
+		return
+	}
+	exists := make(map[string]gin.H, len(rows))
+	missing := make([]string, 0)
+	for _, name := range names {
+		row, ok := rows[name]
+		if !ok {
+			missing = append(missing, name)
+			continue
+		}
+		exists[name] = downloadSaveData(row)
+	}
+	c.JSON(200, gin.H{"status": "true", "exists": exists, "missing": missing})
+}
+
+/*
+ServerSaveBatch
+Body is a JSON array of {name, group, desc, local_address, type}, all rows are inserted
+in one transaction and every item reports created, exists or failed.
+*/
+func ServerSaveBatch(c *gin.Context, database databases.Databases) {
+	if !checkAskParam(c, database, askScopeSave) {
+		return
+	}
+	var records []downloadSaveRecord
+	if err := c.ShouldBindJSON(&records); err != nil {
+		c.JSON(400, gin.H{"status": "false", "error": "invalid body"})
+		return
+	}
+	if len(records) == 0 || len(records) > maxBatchItems {
+		c.JSON(400, gin.H{"status": "false", "error": fmt.Sprintf("expect 1 to %d records", maxBatchItems)})
+		return
+	}
+	results := make([]databases.DownloadSaveResult, len(records))
+	var items []databases.DownloadSave
+	var index []int
+	names := make([]string, 0, len(records))
+	for i, r := range records {
+		if r.Name == "" {
+			results[i] = databases.DownloadSaveResult{Status: "failed", Error: "missing name"}
+			continue
+		}
+		items = append(items, databases.DownloadSave{Name: r.Name, Group: r.Group, Desc: r.Desc, LocalAddress: r.LocalAddress, Type: r.Type})
+		index = append(index, i)
+		names = append(names, r.Name)
+	}
+	setAuditTarget(c, "names", strings.Join(names, ","))
+	if len(items) > 0 {
+		saved, err := database.InsertDownloadSaves(c.Request.Context(), items)
+		if err != nil {
+			c.JSON(500, gin.H{"status": "false"})
+			return
+		}
+		for j, r := range saved {
+			results[index[j]] = r
+		}
+	}
+	counts := map[string]int{"created": 0, "exists": 0, "failed": 0}
+	for _, r := range results {
+		counts[r.Status]++
+	}
+	c.JSON(200, gin.H{"status": "true", "items": results, "counts": counts})
+}
+
+func AskList(c *gin.Context, database databases.Databases) {
+	items, err := database.ListAsk(c.Request.Context())
+	if err != nil {
+		c.JSON(500, gin.H{"error": "list failed"})
+		return
+	}
+	c.JSON(200, gin.H{"items": items})
+}
+
+/*
+AskCreate
+name labels the key, scopes is a comma separated subset of duplicate,save (empty allows both)
+and days sets the expiry, 0 or empty never expires.
+*/
+func AskCreate(c *gin.Context, database databases.Databases) {
+	name := strings.TrimSpace(c.PostForm("name"))
+	var scopes []string
+	for _, sc := range strings.Split(c.PostForm("scopes"), ",") {
+		sc = strings.TrimSpace(sc)
+		if sc == "" {
+			continue
+		}
+		if !askScopes[sc] {
+			c.JSON(400, gin.H{"error": "invalid scope " + sc})
+			return
+		}
+		scopes = append(scopes, sc)
+	}
+	days := 0
+	if d := strings.TrimSpace(c.PostForm("days")); d != "" {
+		v, err := strconv.Atoi(d)
+		if err != nil || v < 0 {
+			c.JSON(400, gin.H{"error": "invalid days"})
+			return
+		}
+		days = v
+	}
+	key, err := database.CreateAsk(c.Request.Context(), name, scopes, time.Duration(days)*24*time.Hour)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "create failed"})
+		return
+	}
+	c.JSON(200, gin.H{"id": key.Id, "ask": key.Ask, "key": key})
+}
+
+// AskRotate issues a replacement key, the old one keeps working for grace hours (default 24)
+func AskRotate(c *gin.Context, database databases.Databases) {
+	id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+	if id <= 0 {
+		c.JSON(400, gin.H{"error": "invalid id"})
+		return
+	}
+	grace := 24
+	if g := strings.TrimSpace(c.PostForm("grace")); g != "" {
+		v, err := strconv.Atoi(g)
+		if err != nil || v < 0 {
+			c.JSON(400, gin.H{"error": "invalid grace"})
+			return
+		}
+		grace = v
+	}
+	key, err := database.RotateAsk(c.Request.Context(), id, time.Duration(grace)*time.Hour)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "rotate failed"})
+		return
+	}
+	if key == nil {
+		c.JSON(404, gin.H{"error": "not found"})
+		return
+	}
+	c.JSON(200, gin.H{"id": key.Id, "ask": key.Ask, "key": key})
+}
+
+func AskDelete(c *gin.Context, database databases.Databases) {
+	idStr := c.Param("id")
+	id, _ := strconv.ParseInt(idStr, 10, 64)
+	if id <= 0 {
+		c.JSON(400, gin.H{"error": "invalid id"})
+		return
+	}
+	if err := database.DeleteAsk(c.Request.Context(), id); err != nil {
+		c.JSON(500, gin.H{"error": "delete failed"})
+		return
+	}
+	c.JSON(200, gin.H{"ok": true})
+}
+
+// minPasswordLength applies to users created or reset through the API
+const minPasswordLength = 8
+
+// userData the user fields returned by the API, never the password or token
+func userData(u databases.UserLogin) gin.H {
+	return gin.H{
+		"id":        u.Id,
+		"username":  u.Username,
+		"role":      u.Role,
+		"disabled":  u.Disabled,
+		"createdAt": u.CreatedAt,
+		"oidc":      u.OIDCSubject != "",
+	}
+}
+
+// userFromParam loads the user named by the :id route param, writing the error response itself
+func userFromParam(c *gin.Context, database databases.Databases) *databases.UserLogin {
+	id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+	if id <= 0 {
+		c.JSON(400, gin.H{"error": "invalid id"})
+		return nil
+	}
+	u, err := database.GetUserByID(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "get user failed"})
+		return nil
+	}
+	if u == nil {
+		c.JSON(404, gin.H{"error": "not found"})
+		return nil
+	}
+	return u
+}
+
+// isLastAdmin reports whether u is the only enabled admin left
+func isLastAdmin(ctx context.Context, database databases.Databases, u *databases.UserLogin) (bool, error) {
+	if u.Role != roleAdmin || u.Disabled {
+		return false, nil
+	}
+	users, err := database.ListUsers(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, other := range users {
+		if other.Id != u.Id && other.Role == roleAdmin && !other.Disabled {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func UsersList(c *gin.Context, database databases.Databases) {
+	users, err := database.ListUsers(c.Request.Context())
+	if err != nil {
+		c.JSON(500, gin.H{"error": "list failed"})
+		return
+	}
+	items := make([]gin.H, 0, len(users))
+	for _, u := range users {
+		items = append(items, userData(u))
+	}
+	c.JSON(200, gin.H{"items": items})
+}
+
+func UserCreate(c *gin.Context, database databases.Databases) {
+	username := strings.TrimSpace(c.PostForm("username"))
+	password := c.PostForm("password")
+	role := c.DefaultPostForm("role", roleViewer)
+	if username == "" {
+		c.JSON(400, gin.H{"error": "missing username"})
+		return
+	}
+	if len(password) < minPasswordLength {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("password must have at least %d characters", minPasswordLength)})
+		return
+	}
+	if _, ok := roleRank[role]; !ok {
+		c.JSON(400, gin.H{"error": "invalid role"})
+		return
+	}
+	exist, err := database.GetUserByUsername(c.Request.Context(), username)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "create failed"})
+		return
+	}
+	if exist != nil {
+		c.JSON(409, gin.H{"error": "username already exists"})
+		return
+	}
+	id, err := database.CreateUser(c.Request.Context(), username, password, role)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "create failed"})
+		return
+	}
+	c.JSON(200, gin.H{"ok": true, "id": id})
+}
+
+// UserUpdate changes the role of a user, the last enabled admin cannot be demoted
+func UserUpdate(c *gin.Context, database databases.Databases) {
+	u := userFromParam(c, database)
+	if u == nil {
+		return
+	}
+	role := c.PostForm("role")
+	if _, ok := roleRank[role]; !ok {
+		c.JSON(400, gin.H{"error": "invalid role"})
+		return
+	}
+	if role != roleAdmin {
+		last, err := isLastAdmin(c.Request.Context(), database, u)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "update failed"})
+			return
+		}
+		if last {
+			c.JSON(409, gin.H{"error": "cannot demote the last admin"})
+			return
+		}
+	}
+	if err := database.SetUserRole(c.Request.Context(), u.Id, role); err != nil {
+		c.JSON(500, gin.H{"error": "update failed"})
+		return
+	}
+	updateUserSessions(u.Id, func(sess *Session) bool {
+		sess.Role = role
+		return true
+	})
+	c.JSON(200, gin.H{"ok": true})
+}
+
+// UserDisable disabled=1 disables the user and ends its sessions, disabled=0 enables it again
+func UserDisable(c *gin.Context, database databases.Databases) {
+	u := userFromParam(c, database)
+	if u == nil {
+		return
+	}
+	disabled := c.DefaultPostForm("disabled", "1") == "1"
+	if disabled {
+		if u.Id == sessionUserID(c) {
+			c.JSON(409, gin.H{"error": "cannot disable yourself"})
+			return
+		}
+		last, err := isLastAdmin(c.Request.Context(), database, u)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "update failed"})
+			return
+		}
+		if last {
+			c.JSON(409, gin.H{"error": "cannot disable the last admin"})
+			return
+		}
+	}
+	if err := database.SetUserDisabled(c.Request.Context(), u.Id, disabled); err != nil {
+		c.JSON(500, gin.H{"error": "update failed"})
+		return
+	}
+	if disabled {
+		updateUserSessions(u.Id, func(sess *Session) bool { return false })
+	}
+	c.JSON(200, gin.H{"ok": true})
+}
+
+// UserPassword resets the password of a user, other sessions of that user are ended
+func UserPassword(c *gin.Context, database databases.Databases) {
+	u := userFromParam(c, database)
+	if u == nil {
+		return
+	}
+	password := c.PostForm("password")
+	if len(password) < minPasswordLength {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("password must have at least %d characters", minPasswordLength)})
+		return
+	}
+	if err := database.SetUserPassword(c.Request.Context(), u.Id, password); err != nil {
+		c.JSON(500, gin.H{"error": "update failed"})
+		return
+	}
+	current, _ := c.Cookie("session_token")
+	sessionStore.mu.Lock()
+	for token, sess := range sessionStore.m {
+		if sess.UserID == u.Id && token != current {
+			delete(sessionStore.m, token)
+		}
+	}
+	sessionStore.mu.Unlock()
+	c.JSON(200, gin.H{"ok": true})
+}
+
+// UserOIDC links the user to an OpenID subject (issuer|sub, as logged by a refused login), an empty subject unlinks it
+func UserOIDC(c *gin.Context, database databases.Databases) {
+	u := userFromParam(c, database)
+	if u == nil {
+		return
+	}
+	subject := strings.TrimSpace(c.PostForm("subject"))
+	if subject != "" {
+		if !strings.Contains(subject, "|") {
+			c.JSON(400, gin.H{"error": "subject must be issuer|sub"})
+			return
+		}
+		other, err := database.GetUserByOIDCSubject(c.Request.Context(), subject)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "update failed"})
+			return
+		}
+		if other != nil && other.Id != u.Id {
+			c.JSON(409, gin.H{"error": "subject is linked to " + other.Username})
+			return
+		}
+	}
+	if err := database.SetUserOIDCSubject(c.Request.Context(), u.Id, subject); err != nil {
+		c.JSON(500, gin.H{"error": "update failed"})
+		return
+	}
+	c.JSON(200, gin.H{"ok": true})
+}
+
+// AuditList filters: user, route (prefix), method, result (ok or error), from/to (YYYY-MM-DD)
+func AuditList(c *gin.Context, database databases.Databases) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("pageSize", "50"))
+	filter := databases.AuditLogFilter{
+		Actor:  strings.TrimSpace(c.Query("user")),
+		Route:  strings.TrimSpace(c.Query("route")),
+		Method: strings.TrimSpace(c.Query("method")),
+		Result: c.Query("result"),
+		From:   c.Query("from"),
+		To:     c.Query("to"),
+	}
+	for _, d := range []string{filter.From, filter.To} {
+		if d == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", d); err != nil {
+			c.JSON(400, gin.H{"error": "invalid date " + d})
+			return
+		}
+	}
+	items, total, err := database.ListAuditLogs(c.Request.Context(), filter, page, pageSize)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "list failed"})
+		return
+	}
+	if items == nil {
+		items = []databases.AuditLog{}
+	}
+	c.JSON(200, gin.H{"items": items, "total": total})
+}
+
+// apiTokenData the token fields returned by the API, the secret is only added on creation
+func apiTokenData(t databases.APIToken) gin.H {
+	return gin.H{
+		"id":         t.Id,
+		"userId":     t.UserId,
+		"username":   t.Username,
+		"name":       t.Name,
+		"prefix":     t.Prefix,
+		"expiresAt":  t.ExpiresAt,
+		"lastUsedAt": t.LastUsedAt,
+		"revokedAt":  t.RevokedAt,
+		"createdAt":  t.CreatedAt,
+	}
+}
+
+// APITokensList the tokens of the logged in user, all=1 lists every user's tokens for admins
+func APITokensList(c *gin.Context, database databases.Databases) {
+	sess, _ := currentSession(c)
+	userID := sess.UserID
+	if c.Query("all") == "1" && sess.Role == roleAdmin {
+		userID = 0
+	}
+	list, err := database.ListAPITokens(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "list failed"})
+		return
+	}
+	items := make([]gin.H, 0, len(list))
+	for _, t := range list {
+		items = append(items, apiTokenData(t))
+	}
+	c.JSON(200, gin.H{"items": items})
+}
+
+// APITokenCreate name labels the token, days sets the expiry (0 or empty never expires)
+func APITokenCreate(c *gin.Context, database databases.Databases) {
+	name := strings.TrimSpace(c.PostForm("name"))
+	if name == "" {
+		c.JSON(400, gin.H{"error": "missing name"})
+		return
+	}
+	days := 0
+	if d := strings.TrimSpace(c.PostForm("days")); d != "" {
+		v, err := strconv.Atoi(d)
+		if err != nil || v < 0 {
+			c.JSON(400, gin.H{"error": "invalid days"})
+			return
+		}
+		days = v
+	}
+	t, err := database.CreateAPIToken(c.Request.Context(), sessionUserID(c), name, time.Duration(days)*24*time.Hour)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "create failed"})
+		return
+	}
+	data := apiTokenData(*t)
+	data["token"] = t.Token
+	c.JSON(200, gin.H{"ok": true, "item": data})
+}
+
+// APITokenRevoke users revoke their own tokens, admins any token
+func APITokenRevoke(c *gin.Context, database databases.Databases) {
+	id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+	if id <= 0 {
+		c.JSON(400, gin.H{"error": "invalid id"})
+		return
+	}
+	sess, _ := currentSession(c)
+	userID := sess.UserID
+	if sess.Role == roleAdmin {
+		userID = 0
+	}
+	ok, err := database.RevokeAPIToken(c.Request.Context(), id, userID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "revoke failed"})
+		return
+	}
+	if !ok {
+		c.JSON(404, gin.H{"error": "not found"})
+		return
+	}
+	c.JSON(200, gin.H{"ok": true})
+}
+
+// CurrentUser the logged in user and its role, used by the frontend to hide actions
+func CurrentUser(c *gin.Context) {
+	sess, _ := currentSession(c)
+	c.JSON(200, gin.H{"id": sess.UserID, "username": sess.Username, "role": sess.Role})
+}
+
+func autoTagRuleFromForm(c *gin.Context) databases.AutoTagRule {
+	return normalizeAutoTagRule(databases.AutoTagRule{
+		Name:       c.PostForm("name"),
+		Tags:       strings.Split(c.PostForm("tags"), ","),
+		PathGlob:   c.PostForm("glob"),
+		PathRegex:  c.PostForm("regex"),
+		Extensions: strings.Split(c.PostForm("ext"), ","),
+		Camera:     c.PostForm("camera"),
+		DateFrom:   c.PostForm("from"),
+		DateTo:     c.PostForm("to"),
+	})
+}
+
+func AutoTagRulesList(c *gin.Context, database databases.Databases) {
+	c.JSON(200, gin.H{"items": loadAutoTagRules(c.Request.Context(), database)})
+}
+
+func AutoTagRulesAdd(c *gin.Context, database databases.Databases) {
+	rule := autoTagRuleFromForm(c)
+	if rule.Name == "" {
+		c.JSON(400, gin.H{"error": "missing name"})
+		return
+	}
+	if _, err := compileAutoTagRule(rule); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	id, err := database.AddAutoTagRule(c.Request.Context(), rule)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "add failed"})
+		return
+	}
+	c.JSON(200, gin.H{"ok": true, "id": id})
+}
+
+func AutoTagRulesDelete(c *gin.Context, database databases.Databases) {
+	idStr := c.Param("id")
+	id, _ := strconv.ParseInt(idStr, 10, 64)
+	if id <= 0 {
+		c.JSON(400, gin.H{"error": "invalid id"})
+		return
+	}
+	if err := database.DeleteAutoTagRule(c.Request.Context(), id); err != nil {
+		c.JSON(500, gin.H{"error": "delete failed"})
+		return
+	}
+	c.JSON(200, gin.H{"ok": true})
+}
+
+/*
+AutoTagDryRun
+Shows which entries of an index would be tagged, without writing anything.
+Uses the stored rule given by id, or an inline rule built from the form fields,
+or all rules when neither is given.
+*/
+func AutoTagDryRun(c *gin.Context, database databases.Databases) {
+	table := c.PostForm("table")
+	if table == "" {
+		c.JSON(400, gin.H{"error": "missing table"})
+		return
+	}
+	var matchers []*autoTagMatcher
+	if idStr := c.PostForm("id"); idStr != "" {
+		id, _ := strconv.ParseInt(idStr, 10, 64)
+		for _, r := range loadAutoTagRules(c.Request.Context(), database) {
+			if r.Source == "database" && r.Id == id {
+				m, err := compileAutoTagRule(r)
+				if err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
+					return
+				}
+				matchers = append(matchers, m)
+			}
+		}
+		if len(matchers) == 0 {
+			c.JSON(404, gin.H{"error": "rule not found"})
+			return
+		}
+	} else if c.PostForm("tags") != "" {
+		m, err := compileAutoTagRule(autoTagRuleFromForm(c))
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		matchers = append(matchers, m)
+	} else {
+		matchers = loadAutoTagMatchers(c.Request.Context(), database)
+	}
+	const maxItems = 500
+	items := make([]gin.H, 0)
+	matched, scanned := 0, 0
+	err := walkIndexEntries(c.Request.Context(), database, table, func(entries []databases.LocalEntry) error {
+		for _, e := range entries {
+			scanned++
+			tags := autoTagTags(matchers, e)
+			if len(tags) == 0 {
+				continue
+			}
+			matched++
+			if len(items) < maxItems {
+				items = append(items, gin.H{"Path": e.Path, "Type": e.Type, "Tags": tags})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "scan index failed"})
+		return
+	}
+	c.JSON(200, gin.H{"items": items, "matched": matched, "scanned": scanned})
+}
+
+// AutoTagApply re-applies all rules to an existing index
+func AutoTagApply(c *gin.Context, database databases.Databases) {
+	table := c.PostForm("table")
+	if table == "" {
+		c.JSON(400, gin.H{"error": "missing table"})
+		return
+	}
+	matchers := loadAutoTagMatchers(c.Request.Context(), database)
+	tagged := 0
+	err := walkIndexEntries(c.Request.Context(), database, table, func(entries []databases.LocalEntry) error {
+		n, err := applyAutoTags(c.Request.Context(), database, matchers, entries)
+		tagged += n
+		return err
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "apply failed", "tagged": tagged})
+		return
+	}
+	c.JSON(200, gin.H{"ok": true, "tagged": tagged})
+}
+
+// parseIDList parses a comma separated list of positive ids
+func parseIDList(s string) ([]int64, bool) {
+	var ids []int64
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(part, 10, 64)
+		if err != nil || id <= 0 {
+			return nil, false
+		}
+		ids = append(ids, id)
+	}
+	return ids, len(ids) > 0
+}
+
+// albumFromParam loads the album named by the :id route param, writing the error response itself
+func albumFromParam(c *gin.Context, database databases.Databases) *databases.Album {
+	id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+	if id <= 0 {
+		c.JSON(400, gin.H{"error": "invalid id"})
+		return nil
+	}
+	album, err := database.GetAlbum(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "get album failed"})
+		return nil
+	}
+	if album == nil {
+		c.JSON(404, gin.H{"error": "not found"})
+		return nil
+	}
+	return album
+}
+
+// ownedAlbumFromParam like albumFromParam but also requires the user may change the album
+func ownedAlbumFromParam(c *gin.Context, database databases.Databases) *databases.Album {
+	album := albumFromParam(c, database)
+	if album == nil {
+		return nil
+	}
+	if !canModify(c, album.OwnerId) {
+		c.JSON(403, gin.H{"error": "album owned by another user"})
+		return nil
+	}
+	return album
+}
+
+// AlbumsList mine=1 only lists the albums of the logged in user
+func AlbumsList(c *gin.Context, database databases.Databases) {
+	var ownerID int64
+	if c.Query("mine") == "1" {
+		ownerID = sessionUserID(c)
+	}
+	list, err := database.ListAlbums(c.Request.Context(), ownerID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "list failed"})
+		return
+	}
+	c.JSON(200, gin.H{"items": list})
+}
+
+func AlbumCreate(c *gin.Context, database databases.Databases) {
+	name := strings.TrimSpace(c.PostForm("name"))
+	if name == "" {
+		c.JSON(400, gin.H{"error": "missing name"})
+		return
+	}
+	id, err := database.CreateAlbum(c.Request.Context(), name, c.PostForm("desc"), c.PostForm("cover"), sessionUserID(c))
+	if err != nil {
+		c.JSON(500, gin.H{"error": "create failed"})
+		return
+	}
+	c.JSON(200, gin.H{"ok": true, "id": id})
+}
+
+// AlbumUpdate renames an album or changes its description/cover, omitted fields are kept
+func AlbumUpdate(c *gin.Context, database databases.Databases) {
+	album := ownedAlbumFromParam(c, database)
+	if album == nil {
+		return
+	}
+	name, desc, cover := album.Name, album.Description, album.CoverPath
+	if v, ok := c.GetPostForm("name"); ok {
+		name = strings.TrimSpace(v)
+	}
+	if v, ok := c.GetPostForm("desc"); ok {
+		desc = v
+	}
+	if v, ok := c.GetPostForm("cover"); ok {
+		cover = v
+	}
+	if name == "" {
+		c.JSON(400, gin.H{"error": "missing name"})
+		return
+	}
+	if err := database.UpdateAlbum(c.Request.Context(), album.Id, name, desc, cover); err != nil {
+		c.JSON(500, gin.H{"error": "update failed"})
+		return
+	}
+	c.JSON(200, gin.H{"ok": true})
+}
+
+func AlbumDelete(c *gin.Context, database databases.Databases) {
+	album := ownedAlbumFromParam(c, database)
+	if album == nil {
+		return
+	}
+	if err := database.DeleteAlbum(c.Request.Context(), album.Id); err != nil {
+		c.JSON(500, gin.H{"error": "delete failed"})
+		return
+	}
+	c.JSON(200, gin.H{"ok": true})
+}
+
+func AlbumsReorder(c *gin.Context, database databases.Databases) {
+	ids, ok := parseIDList(c.PostForm("ids"))
+	if !ok {
+		c.JSON(400, gin.H{"error": "invalid ids"})
+		return
+	}
+	for _, id := range ids {
+		album, err := database.GetAlbum(c.Request.Context(), id)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "get album failed"})
+			return
+		}
+		if album != nil && !canModify(c, album.OwnerId) {
+			c.JSON(403, gin.H{"error": "album owned by another user", "id": id})
+			return
+		}
+	}
+	if err := database.ReorderAlbums(c.Request.Context(), ids); err != nil {
+		c.JSON(500, gin.H{"error": "reorder failed"})
+		return
+	}
+	c.JSON(200, gin.H{"ok": true})
+}
+
+func AlbumItems(c *gin.Context, database databases.Databases) {
+	album := albumFromParam(c, database)
+	if album == nil {
+		return
+	}
+	items, err := database.ListAlbumItems(c.Request.Context(), album.Id)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "list failed"})
+		return
+	}
+	c.JSON(200, gin.H{"album": album, "items": items})
+}
+
+/*
+AlbumItemsAdd
+type is favorite or file, path may be repeated to add a batch.
+favorite items must already be favorited directories.
+*/
+func AlbumItemsAdd(c *gin.Context, database databases.Databases) {
+	album := ownedAlbumFromParam(c, database)
+	if album == nil {
+		return
+	}
+	typ := c.PostForm("type")
+	if typ != "favorite" && typ != "file" {
+		c.JSON(400, gin.H{"error": "invalid type"})
+		return
+	}
+	var paths []string
+	for _, p := range c.PostFormArray("path") {
+		if p = strings.TrimSpace(p); p != "" {
+			paths = append(paths, p)
+		}
+	}
+	if len(paths) == 0 {
+		c.JSON(400, gin.H{"error": "missing path"})
+		return
+	}
+	if typ == "favorite" {
+		exists, err := database.FavoritesExist(c.Request.Context(), paths)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "lookup failed"})
+			return
+		}
+		var missing []string
+		for _, p := range paths {
+			if !exists[p] {
+				missing = append(missing, p)
+			}
+		}
+		if len(missing) > 0 {
+			c.JSON(400, gin.H{"error": "not a favorite", "paths": missing})
+			return
+		}
+	}
+	items := make([]databases.AlbumItem, 0, len(paths))
+	for _, p := range paths {
+		items = append(items, databases.AlbumItem{AlbumId: album.Id, ItemType: typ, Path: p})
+	}
+	added, err := database.AddAlbumItems(c.Request.Context(), album.Id, items)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "add failed"})
+		return
+	}
+	c.JSON(200, gin.H{"ok": true, "added": added})
+}
+
+func AlbumItemsRemove(c *gin.Context, database databases.Databases) {
+	album := ownedAlbumFromParam(c, database)
+	if album == nil {
+		return
+	}
+	ids, ok := parseIDList(c.PostForm("ids"))
+	if !ok {
+		c.JSON(400, gin.H{"error": "invalid ids"})
+		return
+	}
+	n, err := database.RemoveAlbumItems(c.Request.Context(), album.Id, ids)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "remove failed"})
+		return
+	}
+	c.JSON(200, gin.H{"ok": true, "removed": n})
+}
+
+func AlbumItemsReorder(c *gin.Context, database databases.Databases) {
+	album := ownedAlbumFromParam(c, database)
+	if album == nil {
+		return
+	}
+	ids, ok := parseIDList(c.PostForm("ids"))
+	if !ok {
+		c.JSON(400, gin.H{"error": "invalid ids"})
+		return
+	}
+	if err := database.ReorderAlbumItems(c.Request.Context(), album.Id, ids); err != nil {
+		c.JSON(500, gin.H{"error": "reorder failed"})
+		return
+	}
+	c.JSON(200, gin.H{"ok": true})
+}
+
+// FileMetaGet returns the meta of one or more paths, paths without meta are omitted
+func FileMetaGet(c *gin.Context, database databases.Databases) {
+	paths := c.QueryArray("path")
+	if len(paths) == 0 {
+		c.JSON(400, gin.H{"error": "missing path"})
+		return
+	}
+	items, err := database.GetFileMeta(c.Request.Context(), paths)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "get failed"})
+		return
+	}
+	c.JSON(200, gin.H{"items": items})
+}
+
+// FileMetaSet replaces the rating, color and note of a path, clearing all three removes it
+func FileMetaSet(c *gin.Context, database databases.Databases) {
+	path := c.PostForm("path")
+	if path == "" {
+		c.JSON(400, gin.H{"error": "missing path"})
+		return
+	}
+	rating := 0
+	if r := c.PostForm("rating"); r != "" {
+		v, err := strconv.Atoi(r)
+		if err != nil || v < 0 || v > 5 {
+			c.JSON(400, gin.H{"error": "invalid rating"})
+			return
+		}
+		rating = v
+	}
+	color := strings.ToLower(strings.TrimSpace(c.PostForm("color")))
+	if color != "" && !fileMetaColors[color] {
+		c.JSON(400, gin.H{"error": "invalid color"})
+		return
+	}
+	meta := databases.FileMeta{Path: path, Rating: rating, Color: color, Note: c.PostForm("note")}
+	if err := database.SetFileMeta(c.Request.Context(), meta); err != nil {
+		c.JSON(500, gin.H{"error": "save failed"})
+		return
+	}
+	c.JSON(200, gin.H{"ok": true})
+}
+
+// listAllFavorites pages through every favorite
+func listAllFavorites(ctx context.Context, database databases.Databases) ([]databases.Favorite, error) {
+	var favorites []databases.Favorite
+	for page := 1; ; page++ {
+		items, total, err := database.ListFavorites(ctx, "", page, 200, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		favorites = append(favorites, items...)
+		if len(items) == 0 || len(favorites) >= total {
+			return favorites, nil
+		}
+	}
+}
+
+// FavoritesExport downloads all favorites together with file ratings, color labels and notes
+func FavoritesExport(c *gin.Context, database databases.Databases) {
+	favorites, err := listAllFavorites(c.Request.Context(), database)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "export failed"})
+		return
+	}
+	meta, err := database.ListAllFileMeta(c.Request.Context())
+	if err != nil {
+		c.JSON(500, gin.H{"error": "export failed"})
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=favorites-%s.json", time.Now().Format("20060102150405")))
+	c.JSON(200, gin.H{
+		"exportedAt": time.Now().Format("2006-01-02 15:04:05"),
+		"favorites":  favorites,
+		"fileMeta":   meta,
+	})
+}
+
+type favoriteHealthItem struct {
+	DirPath      string
+	DirHash      string
+	FavoriteName string
+	Problem      string
+}
+
+type favoriteHealthReport struct {
+	Total   int
+	Ok      int
+	Missing []favoriteHealthItem
+}
+
+// checkFavorites stats every favorite directory, web favorites (http/https) are skipped
+func checkFavorites(ctx context.Context, database databases.Databases) (favoriteHealthReport, error) {
+	report := favoriteHealthReport{Missing: []favoriteHealthItem{}}
+	favorites, err := listAllFavorites(ctx, database)
+	if err != nil {
+		return report, err
+	}
+	for _, f := range favorites {
+		lower := strings.ToLower(f.DirPath)
+		if strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") {
+			continue
+		}
+		report.Total++
+		problem := ""
+		fi, err := os.Stat(f.DirPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				problem = "missing"
+			} else {
+				problem = err.Error()
+			}
+		} else if !fi.IsDir() {
+			problem = "not a directory"
+		}
+		if problem == "" {
+			report.Ok++
+			continue
+		}
+		report.Missing = append(report.Missing, favoriteHealthItem{
+			DirPath:      f.DirPath,
+			DirHash:      f.DirHash,
+			FavoriteName: f.FavoriteName,
+			Problem:      problem,
+		})
+	}
+	return report, nil
+}
+
+func FavoritesHealth(c *gin.Context, database databases.Databases) {
+	report, err := checkFavorites(c.Request.Context(), database)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "check failed"})
+		return
+	}
+	c.JSON(200, gin.H{"total": report.Total, "ok": report.Ok, "missing": report.Missing})
+}
+
+/*
+FavoritesRelink
+Rewrites favorite paths from -> to, prefix=1 rewrites every favorite under the from prefix
+(e.g. a moved drive), dryrun=1 only returns the planned changes.
+*/
+func FavoritesRelink(c *gin.Context, database databases.Databases) {
+	from := strings.TrimSpace(c.PostForm("from"))
+	to := strings.TrimSpace(c.PostForm("to"))
+	if from == "" || to == "" {
+		c.JSON(400, gin.H{"error": "missing from or to"})
+		return
+	}
+	dryRun := c.PostForm("dryrun") == "1"
+	plan, err := database.RelinkFavorites(c.Request.Context(), from, to, c.PostForm("prefix") == "1", dryRun)
+	if err != nil {
+		c.JSON(409, gin.H{"error": err.Error()})
+		return
+	}
+	if plan == nil {
+		plan = []databases.FavoriteRelink{}
+	}
+	c.JSON(200, gin.H{"ok": true, "dryRun": dryRun, "items": plan, "count": len(plan)})
+}
@@ -3,14 +3,19 @@ package server
 import (
 	"bwrs/databases"
 	"bwrs/tools"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"gopkg.in/yaml.v3"
 	"k8s.io/klog"
 )
@@ -27,6 +32,9 @@ func klogInit() {
 
 	parameterProcessing()
 	_ = flag.CommandLine.Parse(nil)
+	if f := flag.Lookup("v"); f != nil {
+		startupVerbosity = f.Value.String()
+	}
 	//klog.Infof("klog init: log event %d\n", tools.LogEvent)
 	defer klog.Flush()
 }
@@ -66,10 +74,16 @@ cobra相关内容
 // configFilePath 此变量用于接受--config参数的内容 然后传递到启动函数里
 var configFilePath string
 
+// configFlags 每个配置项对应的覆盖参数，例如 --database.host，优先级高于环境变量与配置文件
+var configFlags = map[string]*pflag.Flag{}
+
 // rootCmd 主命令 也就是不加任何子命令情况 执行此函数
 var rootCmd = cobra.Command{
 	Use:   "config",
 	Short: "input config file address.",
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		configFilePath = resolveConfigPath(configFilePath)
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 		if checkConfigFile(configFilePath) {
 			// 默认启动程序 也就是不加任何子命令 只指定--config参数
@@ -91,21 +105,142 @@ var versionCmd = &cobra.Command{
 // 增加一个新的子命令 init 需要指定参数 --config 这里是他的启动方法
 var initCmd = &cobra.Command{
 	Use:   "init",
-	Short: "used for initializing the environment for the first time.",
+	Short: "create the config, database, tables, admin user and ask key, safe to run again.",
+	Run: func(cmd *cobra.Command, args []string) {
+		runInit()
+	},
+}
+
+// 子命令 validate 检查配置文件并一次性列出所有问题
+var validateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "check the config file and report every problem.",
+	Run: func(cmd *cobra.Command, args []string) {
+		if !checkConfigFile(configFilePath) {
+			return
+		}
+		problems := validateConfig(readConfig(configFilePath))
+		if len(problems) > 0 {
+			problems.report(configFilePath)
+			os.Exit(1)
+		}
+		fmt.Printf("config %s is valid\n", configFilePath)
+	},
+}
+
+// 子命令 favorites 收藏目录的健康检查与重新关联
+var favoritesCmd = &cobra.Command{
+	Use:   "favorites",
+	Short: "check or relink favorite directories.",
+}
+
+var favoritesCheckCmd = &cobra.Command{
+	Use:   "check",
+	Short: "report favorites whose directory is missing.",
 	Run: func(cmd *cobra.Command, args []string) {
 		if checkConfigFile(configFilePath) {
-			initEnvironment(configFilePath)
+			database := initDatabase(readConfig(configFilePath))
+			report, err := checkFavorites(context.Background(), database)
+			if err != nil {
+				klog.Fatalln("check favorites failed:", err)
+			}
+			for _, m := range report.Missing {
+				fmt.Printf("%s\t%s\t%s\n", m.Problem, m.FavoriteName, m.DirPath)
+			}
+			fmt.Printf("total: %d ok: %d missing: %d\n", report.Total, report.Ok, len(report.Missing))
+		}
+	},
+}
+
+// relink 参数
+var relinkFrom, relinkTo string
+var relinkPrefix, relinkDryRun bool
+
+var favoritesRelinkCmd = &cobra.Command{
+	Use:   "relink",
+	Short: "move favorites from an old path (or prefix) to a new one.",
+	Run: func(cmd *cobra.Command, args []string) {
+		if !checkConfigFile(configFilePath) {
+			return
+		}
+		if relinkFrom == "" || relinkTo == "" {
+			klog.Fatalln("please input --from and --to!")
+		}
+		database := initDatabase(readConfig(configFilePath))
+		plan, err := database.RelinkFavorites(context.Background(), relinkFrom, relinkTo, relinkPrefix, relinkDryRun)
+		if err != nil {
+			klog.Fatalln("relink failed:", err)
+		}
+		favorites := 0
+		for _, r := range plan {
+			fmt.Printf("%-8s %s -> %s\n", r.Kind, r.OldPath, r.NewPath)
+			if r.Kind == databases.RelinkFavorite {
+				favorites++
+			}
+		}
+		if relinkDryRun {
+			fmt.Printf("dry run, %d favorites and %d other paths would be relinked\n", favorites, len(plan)-favorites)
+		} else {
+			fmt.Printf("%d favorites and %d other paths relinked\n", favorites, len(plan)-favorites)
 		}
 	},
 }
 
 // init cobra框架 将所有的都添加到rootCmd这个主命令下
 func init() {
-	rootCmd.PersistentFlags().StringVar(&configFilePath, "config", "", "config file path.")
+	rootCmd.PersistentFlags().StringVar(&configFilePath, "config", "", "config file path, relative paths and ~ are allowed (env LPT_CONFIG).")
+	for _, f := range tools.ConfigFields() {
+		rootCmd.PersistentFlags().String(f.Path, "", "override "+f.Path+" (env "+f.Env+").")
+		configFlags[f.Path] = rootCmd.PersistentFlags().Lookup(f.Path)
+	}
 	rootCmd.AddCommand(versionCmd)
-	// 添加一个命令 init 需要指定参数 --config
+	// 添加一个命令 init，未指定 --config 时在当前目录生成 config.yaml
 	initCmd.PersistentFlags().StringVar(&configFilePath, "config", "", "config file path.")
+	initCmd.Flags().StringVar(&initOptions.adminUser, "admin-user", "", "admin username, asked on a terminal when empty.")
+	initCmd.Flags().StringVar(&initOptions.adminPassword, "admin-password", "", "admin password, asked on a terminal when empty.")
+	initCmd.Flags().StringVar(&initOptions.askName, "ask-name", "", "create an ask key with this name unless it exists.")
+	initCmd.Flags().StringVar(&initOptions.askScopes, "ask-scopes", "", "comma separated scopes of the ask key, empty allows all.")
 	rootCmd.AddCommand(initCmd)
+	// 添加一个命令 validate 需要指定参数 --config
+	validateCmd.PersistentFlags().StringVar(&configFilePath, "config", "", "config file path.")
+	rootCmd.AddCommand(validateCmd)
+	// 添加一个命令 favorites 包含 check 与 relink
+	favoritesCmd.PersistentFlags().StringVar(&configFilePath, "config", "", "config file path.")
+	favoritesRelinkCmd.Flags().StringVar(&relinkFrom, "from", "", "old directory path or prefix.")
+	favoritesRelinkCmd.Flags().StringVar(&relinkTo, "to", "", "new directory path or prefix.")
+	favoritesRelinkCmd.Flags().BoolVar(&relinkPrefix, "prefix", false, "rewrite every favorite under --from.")
+	favoritesRelinkCmd.Flags().BoolVar(&relinkDryRun, "dry-run", false, "only print the planned changes.")
+	favoritesCmd.AddCommand(favoritesCheckCmd)
+	favoritesCmd.AddCommand(favoritesRelinkCmd)
+	rootCmd.AddCommand(favoritesCmd)
+}
+
+/*
+resolveConfigPath
+Falls back to LPT_CONFIG and then ./config.yaml when --config is empty,
+expands a leading ~ and makes the path absolute.
+*/
+func resolveConfigPath(path string) string {
+	if path == "" {
+		path = os.Getenv("LPT_CONFIG")
+	}
+	if path == "" {
+		if _, err := os.Stat("config.yaml"); err == nil {
+			path = "config.yaml"
+		}
+	}
+	if path == "" {
+		return ""
+	}
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, strings.TrimPrefix(path, "~"))
+		}
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return path
 }
 
 func checkConfigFile(configFilePath string) bool {
@@ -114,6 +249,10 @@ func checkConfigFile(configFilePath string) bool {
 		klog.Fatalln("please input --config!")
 		return false
 	}
+	if _, err := os.Stat(configFilePath); err != nil {
+		klog.Fatalf("config file %s: %v", configFilePath, err)
+		return false
+	}
 	// fmt.Println("start!Use config file is :", configFilePath)
 	klog.V(2).Info("start!Use config file is :", configFilePath)
 	return true
@@ -135,40 +274,136 @@ New Start
 func NewStart(configFilePath string) {
 	config := readConfig(configFilePath)
 	klog.V(3).Infof("config: %+v\n", config)
-	// 获取数据库连接
-	newDatabase := NewDatabase(config.Database.DataBaseType)
-	if newDatabase == nil {
-		klog.Fatal("newDatabase Not initialized correctly, is nil!")
+	if problems := validateConfig(config); len(problems) > 0 {
+		problems.report(configFilePath)
+		klog.Fatalf("invalid config, run the validate command after fixing it")
 	}
-	newDatabase.Init(config)
-	newDatabase.EnsureUserLoginTable()
-	newDatabase.EnsureButtonsTable()
-	newDatabase.EnsureTagsTables()
-	newDatabase.EnsureDownloadSaveTable()
-	newDatabase.EnsureAskTable()
-	if config.Login.User.Username != "" {
-		_ = newDatabase.UpsertUser(config.Login.User.Username, config.Login.User.Password)
+	if config.TLS.SelfSigned {
+		if config.TLS.CertFile == "" || config.TLS.KeyFile == "" {
+			config.TLS.CertFile, config.TLS.KeyFile = defaultTLSFiles(configFilePath)
+		}
+		if err := ensureSelfSignedCert(config.TLS.CertFile, config.TLS.KeyFile, config.TLS.Hosts); err != nil {
+			klog.Fatalf("generate self-signed certificate failed: %v", err)
+		}
 	}
+	setServiceConfig(config)
+	applyLogVerbosity(config.Log.Verbosity)
+	ctx := context.Background()
+	newDatabase := initDatabase(config)
+	ensureConfigUser(ctx, newDatabase, config.Login.User)
+
+	scheduleVerifyJob(newDatabase, config.DownloadVerify.Interval)
+	scheduleAuditPurge(newDatabase)
+	watchReloadSignal(newDatabase)
 
-	// start gin server
+	// start gin server, it returns after a shutdown signal has drained the requests
 	startGinServer(int(config.Port), newDatabase)
 
+	if err := newDatabase.Close(ctx); err != nil {
+		klog.Errorf("close database failed: %v", err)
+	}
+	klog.Flush()
+}
+
+/*
+ensureConfigUser
+login.user bootstraps the first admin: it is created when missing and left alone
+otherwise, so a demotion, disable or password change made through the users API
+sticks. A differing role, state or password is only logged.
+*/
+func ensureConfigUser(ctx context.Context, database databases.Databases, user tools.UserConfig) {
+	if user.Username == "" {
+		return
+	}
+	u, err := database.GetUserByUsername(ctx, user.Username)
+	if err != nil {
+		klog.Errorf("look up login.user %s failed: %v", user.Username, err)
+		return
+	}
+	if u == nil {
+		if _, err := database.CreateUser(ctx, user.Username, user.Password, roleAdmin); err != nil {
+			klog.Errorf("create login.user %s failed: %v", user.Username, err)
+			return
+		}
+		klog.Infof("created admin %s from login.user", user.Username)
+		return
+	}
+	if u.Role != roleAdmin || u.Disabled {
+		klog.Warningf("login.user %s is %s (disabled: %t) in the database, the config does not override it", u.Username, u.Role, u.Disabled)
+	}
+	if ok, _ := databases.CheckPassword(u.Password, user.Password); !ok {
+		klog.Warningf("login.user %s has a different password in the database, the config does not override it", u.Username)
+	}
+}
+
+// initDatabase connect to the database and make sure all tables exist
+func initDatabase(config tools.ServiceConfig) databases.Databases {
+	// 获取数据库连接
+	ctx := context.Background()
+	newDatabase := NewDatabase(config.Database.DataBaseType)
+	if newDatabase == nil {
+		klog.Fatal("newDatabase Not initialized correctly, is nil!")
+	}
+	newDatabase.Init(ctx, config)
+	newDatabase.EnsureUserLoginTable(ctx)
+	newDatabase.EnsureButtonsTable(ctx)
+	newDatabase.EnsureTagsTables(ctx)
+	newDatabase.EnsureDownloadSaveTable(ctx)
+	newDatabase.EnsureAskTable(ctx)
+	newDatabase.EnsureAlbumsTables(ctx)
+	newDatabase.EnsureFileMetaTable(ctx)
+	newDatabase.EnsureAutoTagRulesTable(ctx)
+	newDatabase.EnsureDownloadSaveCheckTable(ctx)
+	newDatabase.EnsureAuditLogTable(ctx)
+	newDatabase.EnsureAPITokensTable(ctx)
+	return newDatabase
 }
 
 func readConfig(configFilePath string) tools.ServiceConfig {
+	config, err := loadConfig(configFilePath)
+	if err != nil {
+		klog.Fatal(err)
+	}
+	return config
+}
+
+// loadConfig reads the yaml file and applies the environment and command line overrides
+func loadConfig(configFilePath string) (tools.ServiceConfig, error) {
 	var config tools.ServiceConfig
 	yamlFile, err := ioutil.ReadFile(configFilePath)
 	if err != nil {
-		klog.Fatalf("Error reading YAML file: %s\n", err)
+		return config, fmt.Errorf("Error reading YAML file: %s", err)
 	}
 
 	// Parse YAML file content to structure
 	err = yaml.Unmarshal(yamlFile, &config)
 	if err != nil {
-		klog.Fatalf("Error parsing YAML file: %s\n", err)
+		return config, fmt.Errorf("Error parsing YAML file: %s", err)
 	}
 
-	return config
+	// environment variables override the file, command line flags override both
+	if err := tools.ApplyEnvOverrides(&config); err != nil {
+		return config, fmt.Errorf("Error in environment overrides:\n%s", err)
+	}
+	if err := applyConfigFlags(&config); err != nil {
+		return config, fmt.Errorf("Error in command line overrides:\n%s", err)
+	}
+	return config, nil
+}
+
+// applyConfigFlags sets the fields whose --<yaml path> flag was given
+func applyConfigFlags(config *tools.ServiceConfig) error {
+	var errs []error
+	for _, f := range tools.ConfigFields() {
+		flag := configFlags[f.Path]
+		if flag == nil || !flag.Changed {
+			continue
+		}
+		if err := tools.SetConfigField(config, f.Path, flag.Value.String()); err != nil {
+			errs = append(errs, fmt.Errorf("--%s: %v", f.Path, err))
+		}
+	}
+	return errors.Join(errs...)
 }
 
 // NewDatabase return databases interface
@@ -184,7 +419,11 @@ The corresponding method is implemented in the server.go file.
 func startGinServer(port int, database databases.Databases) {
 	var route *gin.Engine
 	route = gin.Default()
+	if err := route.SetTrustedProxies(currentConfig().Session.TrustedProxies); err != nil {
+		klog.Fatalf("invalid session.trustedProxies: %v", err)
+	}
 	route.Use(TrackMetrics())
+	route.Use(AuditLog(database))
 
 	// TODO demo: binding interface
 	route.GET("/api/status/information", func(c *gin.Context) {
@@ -197,73 +436,227 @@ func startGinServer(port int, database databases.Databases) {
 	route.POST("/api/host/add", func(c *gin.Context) {
 		Test(c, database)
 	})
-	route.POST("/api/login", func(c *gin.Context) {
+	route.POST("/api/login", RateLimit(loginRateKey), func(c *gin.Context) {
 		Login(c, database)
 	})
-	route.GET("/api/buttons", AuthRequiredAPI(), func(c *gin.Context) {
+	route.GET("/api/oidc/info", func(c *gin.Context) {
+		OIDCInfo(c)
+	})
+	route.GET("/api/oidc/login", RateLimit(nil), func(c *gin.Context) {
+		OIDCLogin(c)
+	})
+	route.GET("/api/oidc/callback", RateLimit(nil), func(c *gin.Context) {
+		OIDCCallback(c, database)
+	})
+	route.GET("/api/buttons", AuthRequiredAPI(database), func(c *gin.Context) {
 		ButtonsList(c, database)
 	})
-	route.POST("/api/buttons", AuthRequiredAPI(), func(c *gin.Context) {
+	route.POST("/api/buttons", AuthRequiredAPI(database), RequireRole(roleAdmin), func(c *gin.Context) {
 		ButtonsAdd(c, database)
 	})
-	route.DELETE("/api/buttons/:id", AuthRequiredAPI(), func(c *gin.Context) {
+	route.DELETE("/api/buttons/:id", AuthRequiredAPI(database), RequireRole(roleAdmin), func(c *gin.Context) {
 		ButtonsDelete(c, database)
 	})
-	route.GET("/api/dashboard", AuthRequiredAPI(), func(c *gin.Context) {
+	route.GET("/api/dashboard", AuthRequiredAPI(database), func(c *gin.Context) {
 		Dashboard(c, database)
 	})
-	route.POST("/api/local/list", AuthRequiredAPI(), func(c *gin.Context) {
+	route.POST("/api/local/list", AuthRequiredAPI(database), func(c *gin.Context) {
 		LocalList(c, database)
 	})
-	route.POST("/api/local/index", AuthRequiredAPI(), func(c *gin.Context) {
+	route.POST("/api/local/index", AuthRequiredAPI(database), RequireRole(roleEditor), func(c *gin.Context) {
 		LocalIndex(c, database)
 	})
-	route.GET("/api/local/file", AuthRequiredAPI(), func(c *gin.Context) {
+	route.GET("/api/local/file", AuthRequiredAPI(database), func(c *gin.Context) {
 		LocalFile(c, database)
 	})
-	route.GET("/api/tags/search", AuthRequiredAPI(), func(c *gin.Context) {
+	route.GET("/api/tags/search", AuthRequiredAPI(database), func(c *gin.Context) {
 		TagsSearch(c, database)
 	})
-	route.POST("/api/tags/add", AuthRequiredAPI(), func(c *gin.Context) {
+	route.POST("/api/tags/add", AuthRequiredAPI(database), RequireRole(roleEditor), func(c *gin.Context) {
 		TagsAdd(c, database)
 	})
-	route.GET("/api/tags/all", AuthRequiredAPI(), func(c *gin.Context) {
+	route.GET("/api/tags/all", AuthRequiredAPI(database), func(c *gin.Context) {
 		TagsAll(c, database)
 	})
-	route.POST("/api/favorite", AuthRequiredAPI(), func(c *gin.Context) {
+	route.POST("/api/favorite", AuthRequiredAPI(database), RequireRole(roleEditor), func(c *gin.Context) {
 		FavoriteSave(c, database)
 	})
-	route.GET("/api/favorites", AuthRequiredAPI(), func(c *gin.Context) {
+	route.GET("/api/favorites", AuthRequiredAPI(database), func(c *gin.Context) {
 		FavoritesList(c, database)
 	})
-	route.GET("/api/indexes", AuthRequiredAPI(), func(c *gin.Context) {
+	route.GET("/api/favorites/export", AuthRequiredAPI(database), func(c *gin.Context) {
+		FavoritesExport(c, database)
+	})
+	route.GET("/api/favorites/health", AuthRequiredAPI(database), func(c *gin.Context) {
+		FavoritesHealth(c, database)
+	})
+	route.POST("/api/favorites/relink", AuthRequiredAPI(database), RequireRole(roleAdmin), func(c *gin.Context) {
+		FavoritesRelink(c, database)
+	})
+	route.DELETE("/api/favorite/:hash", AuthRequiredAPI(database), RequireRole(roleEditor), func(c *gin.Context) {
+		FavoriteDelete(c, database)
+	})
+	route.POST("/api/favorites/delete", AuthRequiredAPI(database), RequireRole(roleEditor), func(c *gin.Context) {
+		FavoritesDelete(c, database)
+	})
+	route.GET("/api/favorite/exists", AuthRequiredAPI(database), func(c *gin.Context) {
+		FavoriteExists(c, database)
+	})
+	route.POST("/api/favorite/exists", AuthRequiredAPI(database), func(c *gin.Context) {
+		FavoriteExists(c, database)
+	})
+	route.GET("/api/albums", AuthRequiredAPI(database), func(c *gin.Context) {
+		AlbumsList(c, database)
+	})
+	route.POST("/api/albums", AuthRequiredAPI(database), RequireRole(roleEditor), func(c *gin.Context) {
+		AlbumCreate(c, database)
+	})
+	route.POST("/api/albums/reorder", AuthRequiredAPI(database), RequireRole(roleEditor), func(c *gin.Context) {
+		AlbumsReorder(c, database)
+	})
+	route.POST("/api/albums/:id/update", AuthRequiredAPI(database), RequireRole(roleEditor), func(c *gin.Context) {
+		AlbumUpdate(c, database)
+	})
+	route.DELETE("/api/albums/:id", AuthRequiredAPI(database), RequireRole(roleEditor), func(c *gin.Context) {
+		AlbumDelete(c, database)
+	})
+	route.GET("/api/albums/:id/items", AuthRequiredAPI(database), func(c *gin.Context) {
+		AlbumItems(c, database)
+	})
+	route.POST("/api/albums/:id/items", AuthRequiredAPI(database), RequireRole(roleEditor), func(c *gin.Context) {
+		AlbumItemsAdd(c, database)
+	})
+	route.POST("/api/albums/:id/items/remove", AuthRequiredAPI(database), RequireRole(roleEditor), func(c *gin.Context) {
+		AlbumItemsRemove(c, database)
+	})
+	route.POST("/api/albums/:id/items/reorder", AuthRequiredAPI(database), RequireRole(roleEditor), func(c *gin.Context) {
+		AlbumItemsReorder(c, database)
+	})
+	route.GET("/api/indexes", AuthRequiredAPI(database), func(c *gin.Context) {
 		IndexesList(c, database)
 	})
-	route.GET("/api/indexes/files", AuthRequiredAPI(), func(c *gin.Context) {
+	route.GET("/api/indexes/files", AuthRequiredAPI(database), func(c *gin.Context) {
 		IndexFiles(c, database)
 	})
-	route.GET("/api/indexes/info", AuthRequiredAPI(), func(c *gin.Context) {
+	route.GET("/api/indexes/info", AuthRequiredAPI(database), func(c *gin.Context) {
 		IndexInfo(c, database)
 	})
-	route.GET("/api/indexes/search", AuthRequiredAPI(), func(c *gin.Context) {
+	route.GET("/api/indexes/search", AuthRequiredAPI(database), func(c *gin.Context) {
 		IndexSearch(c, database)
 	})
-	route.GET("/api/server/duplicate", func(c *gin.Context) {
+	route.GET("/api/filemeta", AuthRequiredAPI(database), func(c *gin.Context) {
+		FileMetaGet(c, database)
+	})
+	route.POST("/api/filemeta", AuthRequiredAPI(database), RequireRole(roleEditor), func(c *gin.Context) {
+		FileMetaSet(c, database)
+	})
+	route.GET("/api/server/duplicate", RateLimit(askRateKey), func(c *gin.Context) {
+		ServerDuplicate(c, database)
+	})
+	route.GET("/api/server/save", RateLimit(askRateKey), func(c *gin.Context) {
+		ServerSave(c, database)
+	})
+	route.POST("/api/server/duplicate", RateLimit(askRateKey), func(c *gin.Context) {
 		ServerDuplicate(c, database)
 	})
-	route.GET("/api/server/save", func(c *gin.Context) {
+	route.POST("/api/server/save", RateLimit(askRateKey), func(c *gin.Context) {
 		ServerSave(c, database)
 	})
-	route.GET("/api/ask/list", AuthRequiredAPI(), func(c *gin.Context) {
+	route.GET("/api/downloads", AuthRequiredAPI(database), func(c *gin.Context) {
+		DownloadsList(c, database)
+	})
+	route.GET("/api/downloads/groups", AuthRequiredAPI(database), func(c *gin.Context) {
+		DownloadGroups(c, database)
+	})
+	route.POST("/api/downloads/relocate", AuthRequiredAPI(database), RequireRole(roleAdmin), func(c *gin.Context) {
+		DownloadsRelocate(c, database)
+	})
+	route.POST("/api/downloads/verify", AuthRequiredAPI(database), RequireRole(roleEditor), func(c *gin.Context) {
+		DownloadsVerify(c, database)
+	})
+	route.GET("/api/downloads/verify/report", AuthRequiredAPI(database), func(c *gin.Context) {
+		DownloadsVerifyReport(c, database)
+	})
+	route.GET("/api/downloads/:id", AuthRequiredAPI(database), func(c *gin.Context) {
+		DownloadGet(c, database)
+	})
+	route.POST("/api/downloads/:id/update", AuthRequiredAPI(database), RequireRole(roleEditor), func(c *gin.Context) {
+		DownloadUpdate(c, database)
+	})
+	route.DELETE("/api/downloads/:id", AuthRequiredAPI(database), RequireRole(roleEditor), func(c *gin.Context) {
+		DownloadDelete(c, database)
+	})
+	route.POST("/api/server/duplicate/batch", RateLimit(askRateKey), func(c *gin.Context) {
+		ServerDuplicateBatch(c, database)
+	})
+	route.POST("/api/server/save/batch", RateLimit(askRateKey), func(c *gin.Context) {
+		ServerSaveBatch(c, database)
+	})
+	route.GET("/api/ask/list", AuthRequiredAPI(database), RequireRole(roleAdmin), func(c *gin.Context) {
 		AskList(c, database)
 	})
-	route.POST("/api/ask/create", AuthRequiredAPI(), func(c *gin.Context) {
+	route.POST("/api/ask/create", AuthRequiredAPI(database), RequireRole(roleAdmin), func(c *gin.Context) {
 		AskCreate(c, database)
 	})
-	route.DELETE("/api/ask/:id", AuthRequiredAPI(), func(c *gin.Context) {
+	route.POST("/api/ask/:id/rotate", AuthRequiredAPI(database), RequireRole(roleAdmin), func(c *gin.Context) {
+		AskRotate(c, database)
+	})
+	route.DELETE("/api/ask/:id", AuthRequiredAPI(database), RequireRole(roleAdmin), func(c *gin.Context) {
 		AskDelete(c, database)
 	})
+	route.GET("/api/audit", AuthRequiredAPI(database), RequireRole(roleAdmin), func(c *gin.Context) {
+		AuditList(c, database)
+	})
+	route.POST("/api/config/reload", AuthRequiredAPI(database), RequireRole(roleAdmin), func(c *gin.Context) {
+		ConfigReload(c, database)
+	})
+	route.GET("/api/tokens", AuthRequiredAPI(database), RequireCookieSession(), func(c *gin.Context) {
+		APITokensList(c, database)
+	})
+	route.POST("/api/tokens", AuthRequiredAPI(database), RequireCookieSession(), func(c *gin.Context) {
+		APITokenCreate(c, database)
+	})
+	route.DELETE("/api/tokens/:id", AuthRequiredAPI(database), func(c *gin.Context) {
+		APITokenRevoke(c, database)
+	})
+	route.GET("/api/me", AuthRequiredAPI(database), func(c *gin.Context) {
+		CurrentUser(c)
+	})
+	route.GET("/api/users", AuthRequiredAPI(database), RequireRole(roleAdmin), func(c *gin.Context) {
+		UsersList(c, database)
+	})
+	route.POST("/api/users", AuthRequiredAPI(database), RequireRole(roleAdmin), func(c *gin.Context) {
+		UserCreate(c, database)
+	})
+	route.POST("/api/users/:id/update", AuthRequiredAPI(database), RequireRole(roleAdmin), func(c *gin.Context) {
+		UserUpdate(c, database)
+	})
+	route.POST("/api/users/:id/disable", AuthRequiredAPI(database), RequireRole(roleAdmin), func(c *gin.Context) {
+		UserDisable(c, database)
+	})
+	route.POST("/api/users/:id/password", AuthRequiredAPI(database), RequireRole(roleAdmin), func(c *gin.Context) {
+		UserPassword(c, database)
+	})
+	route.POST("/api/users/:id/oidc", AuthRequiredAPI(database), RequireRole(roleAdmin), func(c *gin.Context) {
+		UserOIDC(c, database)
+	})
+	route.GET("/api/autotag/rules", AuthRequiredAPI(database), func(c *gin.Context) {
+		AutoTagRulesList(c, database)
+	})
+	route.POST("/api/autotag/rules", AuthRequiredAPI(database), RequireRole(roleAdmin), func(c *gin.Context) {
+		AutoTagRulesAdd(c, database)
+	})
+	route.DELETE("/api/autotag/rules/:id", AuthRequiredAPI(database), RequireRole(roleAdmin), func(c *gin.Context) {
+		AutoTagRulesDelete(c, database)
+	})
+	route.POST("/api/autotag/dryrun", AuthRequiredAPI(database), func(c *gin.Context) {
+		AutoTagDryRun(c, database)
+	})
+	route.POST("/api/autotag/apply", AuthRequiredAPI(database), RequireRole(roleEditor), func(c *gin.Context) {
+		AutoTagApply(c, database)
+	})
 
-	klog.V(1).Infof("start gin server on port %d", port)
-	_ = route.Run(fmt.Sprintf(":%d", port))
+	if err := serveHTTP(route, port); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		klog.Errorf("gin server stopped: %v", err)
+	}
 }
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"k8s.io/klog"
+)
+
+/*
+TLS
+The server speaks HTTPS when a certificate is configured, a self-signed certificate
+can be generated for LAN use, and downloader clients may authenticate with a client
+certificate signed by tls.clientCAFile.
+*/
+
+func tlsEnabled() bool {
+	t := currentConfig().TLS
+	return t.SelfSigned || (t.CertFile != "" && t.KeyFile != "")
+}
+
+// defaultTLSFiles places generated certificates next to the config file when no paths are configured
+func defaultTLSFiles(configFilePath string) (string, string) {
+	dir := filepath.Join(filepath.Dir(configFilePath), "tls")
+	return filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+}
+
+/*
+ensureSelfSignedCert
+Keeps existing files, otherwise writes an ECDSA certificate valid for hosts,
+localhost and the machine hostname.
+*/
+func ensureSelfSignedCert(certFile string, keyFile string, hosts []string) error {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if certErr == nil && keyErr == nil {
+		return nil
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	names := append([]string{"localhost", "127.0.0.1", "::1"}, hosts...)
+	if h, err := os.Hostname(); err == nil {
+		names = append(names, h)
+	}
+	tmpl := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "local_picture_tools", Organization: []string{"local_picture_tools"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(5, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	seen := map[string]bool{}
+	for _, n := range names {
+		if n == "" || seen[n] {
+			continue
+		}
+		seen[n] = true
+		if ip := net.ParseIP(n); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, n)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.MkdirAll(filepath.Dir(f), 0o700); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		return err
+	}
+	klog.Infof("generated self-signed certificate %s for %v", certFile, append(tmpl.DNSNames, ipStrings(tmpl.IPAddresses)...))
+	return nil
+}
+
+func ipStrings(ips []net.IP) []string {
+	out := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		out = append(out, ip.String())
+	}
+	return out
+}
+
+// serverTLSConfig client certificates are requested only when a client CA is configured
+func serverTLSConfig() (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	caFile := currentConfig().TLS.ClientCAFile
+	if caFile == "" {
+		return cfg, nil
+	}
+	pemData, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemData) {
+		return nil, fmt.Errorf("no certificate found in %s", caFile)
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	return cfg, nil
+}
+
+// clientCertName the common name of a verified client certificate, empty without one
+func clientCertName(c *gin.Context) string {
+	if c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0 || len(c.Request.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	name := c.Request.TLS.VerifiedChains[0][0].Subject.CommonName
+	if name == "" {
+		name = "client"
+	}
+	return name
+}
+
+/*
+clientCertAllows
+The OU values of a verified client certificate that name ask scopes (duplicate, save)
+limit it to those scopes. A certificate without such an OU may call every downloader
+endpoint, like an ask key without scopes. Expiry is the certificate's own NotAfter.
+*/
+func clientCertAllows(c *gin.Context, scope string) bool {
+	if c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0 || len(c.Request.TLS.VerifiedChains[0]) == 0 {
+		return false
+	}
+	scoped := false
+	for _, ou := range c.Request.TLS.VerifiedChains[0][0].Subject.OrganizationalUnit {
+		if !askScopes[ou] {
+			continue
+		}
+		if ou == scope {
+			return true
+		}
+		scoped = true
+	}
+	return !scoped
+}
+
+// redirectServer answers plain HTTP requests with a permanent redirect to the HTTPS port
+func redirectServer(redirectPort int, httpsPort int) *http.Server {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		target := "https://" + net.JoinHostPort(host, fmt.Sprintf("%d", httpsPort)) + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	})
+	return &http.Server{
+		Addr:              fmt.Sprintf(":%d", redirectPort),
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       time.Minute,
+	}
+}
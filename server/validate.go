@@ -0,0 +1,260 @@
+package server
+
+import (
+	"bwrs/tools"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Config validation
+Checks the whole configuration before anything is started and collects every
+problem with the yaml path of the offending field, instead of failing on the
+first one deep inside the database driver.
+*/
+
+type configProblem struct {
+	Field   string
+	Message string
+}
+
+func (p configProblem) String() string {
+	return p.Field + ": " + p.Message
+}
+
+type configProblems []configProblem
+
+func (ps *configProblems) add(field string, format string, args ...any) {
+	*ps = append(*ps, configProblem{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (ps *configProblems) port(field string, port int, required bool) {
+	if port == 0 {
+		if required {
+			ps.add(field, "is required")
+		}
+		return
+	}
+	if port < 1 || port > 65535 {
+		ps.add(field, "must be between 1 and 65535, got %d", port)
+	}
+}
+
+// duration an empty value is fine, min applies to non-zero values
+func (ps *configProblems) duration(field string, value string, min time.Duration) {
+	if value == "" {
+		return
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		ps.add(field, "invalid duration %q, use values like 30s, 5m or 1h", value)
+		return
+	}
+	if d < 0 {
+		ps.add(field, "must not be negative")
+	} else if d != 0 && d < min {
+		ps.add(field, "must be at least %s", min)
+	}
+}
+
+func (ps *configProblems) file(field string, path string) bool {
+	if _, err := os.Stat(path); err != nil {
+		ps.add(field, "cannot read %s: %v", path, err)
+		return false
+	}
+	return true
+}
+
+// mysqlNamePattern database names are used unquoted by CREATE DATABASE
+var mysqlNamePattern = regexp.MustCompile(`^[A-Za-z0-9_$]{1,64}$`)
+
+// report prints the problems to stderr, one field per line
+func (ps configProblems) report(configFilePath string) {
+	fmt.Fprintf(os.Stderr, "config %s has %d problem(s):\n", configFilePath, len(ps))
+	for _, p := range ps {
+		fmt.Fprintf(os.Stderr, "  %s\n", p)
+	}
+}
+
+// validateConfig returns every problem found, an empty list means the config can be started
+func validateConfig(cfg tools.ServiceConfig) configProblems {
+	var ps configProblems
+
+	ps.port("port", cfg.Port, true)
+	ps.duration("server.readHeaderTimeout", cfg.Server.ReadHeaderTimeout, 0)
+	ps.duration("server.readTimeout", cfg.Server.ReadTimeout, 0)
+	ps.duration("server.writeTimeout", cfg.Server.WriteTimeout, 0)
+	ps.duration("server.idleTimeout", cfg.Server.IdleTimeout, 0)
+	ps.duration("server.shutdownTimeout", cfg.Server.ShutdownTimeout, time.Second)
+
+	db := cfg.Database
+	switch db.DataBaseType {
+	case "":
+		ps.add("database.databaseType", "is required, use mysql or mongodb")
+	case "mysql":
+		if db.Host == "" {
+			ps.add("database.host", "is required for mysql")
+		}
+		ps.port("database.port", db.Port, true)
+		if db.Path == "" {
+			ps.add("database.path", "is required for mysql, it is the database name")
+		} else if !mysqlNamePattern.MatchString(db.Path) {
+			ps.add("database.path", "%q is not a valid database name, use letters, digits and _", db.Path)
+		}
+		if db.Description.Username == "" {
+			ps.add("database.description.username", "is required for mysql")
+		}
+	case "mongodb":
+		if db.ConnPath == "" && db.Host == "" {
+			ps.add("database.host", "is required for mongodb when connPath is empty")
+		}
+		ps.port("database.port", db.Port, false)
+		if db.BaseName == "" {
+			ps.add("database.basename", "is required for mongodb")
+		}
+	default:
+		ps.add("database.databaseType", "unknown type %q, use mysql or mongodb", db.DataBaseType)
+	}
+	ps.duration("database.queryTimeout", db.QueryTimeout, 0)
+
+	user := cfg.Login.User
+	if user.Username != "" && user.Password == "" {
+		ps.add("login.user.password", "is required when login.user.username is set")
+	}
+	if user.Username == "" && user.Password != "" {
+		ps.add("login.user.username", "is required when login.user.password is set")
+	}
+
+	validateTLSConfig(&ps, cfg)
+
+	switch strings.ToLower(cfg.Session.SameSite) {
+	case "", "lax", "strict":
+	default:
+		ps.add("session.sameSite", "unknown value %q, use lax or strict", cfg.Session.SameSite)
+	}
+	for i, p := range cfg.Session.TrustedProxies {
+		if net.ParseIP(p) == nil {
+			if _, _, err := net.ParseCIDR(p); err != nil {
+				ps.add(fmt.Sprintf("session.trustedProxies[%d]", i), "%q is neither an IP address nor a CIDR", p)
+			}
+		}
+	}
+
+	validateOIDCConfig(&ps, cfg.OIDC)
+
+	rl := cfg.RateLimit
+	if rl.IPRate < 0 {
+		ps.add("rateLimit.ipRate", "must not be negative")
+	}
+	if rl.IPBurst < 0 {
+		ps.add("rateLimit.ipBurst", "must not be negative")
+	}
+	if rl.KeyRate < 0 {
+		ps.add("rateLimit.keyRate", "must not be negative")
+	}
+	if rl.KeyBurst < 0 {
+		ps.add("rateLimit.keyBurst", "must not be negative")
+	}
+	if rl.MaxLoginFailures < 0 {
+		ps.add("rateLimit.maxLoginFailures", "must not be negative")
+	}
+	ps.duration("rateLimit.lockoutDuration", rl.LockoutDuration, 0)
+
+	if cfg.Audit.RetentionDays < 0 {
+		ps.add("audit.retentionDays", "must not be negative, 0 keeps entries forever")
+	}
+	ps.duration("downloadVerify.interval", cfg.DownloadVerify.Interval, time.Minute)
+	if v := cfg.Log.Verbosity; v != "" {
+		if n, err := strconv.Atoi(v); err != nil || n < 0 {
+			ps.add("log.verbosity", "%q is not a klog level, use 0 to 10", v)
+		}
+	}
+
+	for i, r := range configAutoTagRules(cfg) {
+		if _, err := compileAutoTagRule(r); err != nil {
+			ps.add(fmt.Sprintf("autoTag.rules[%d]", i), "%v", err)
+		}
+	}
+	return ps
+}
+
+func validateTLSConfig(ps *configProblems, cfg tools.ServiceConfig) {
+	t := cfg.TLS
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		ps.add("tls.certFile", "certFile and keyFile must be set together")
+	}
+	// a self-signed certificate is generated when the files do not exist yet
+	if t.CertFile != "" && t.KeyFile != "" && !t.SelfSigned {
+		if ps.file("tls.certFile", t.CertFile) && ps.file("tls.keyFile", t.KeyFile) {
+			if _, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile); err != nil {
+				ps.add("tls.certFile", "cannot load certificate and key: %v", err)
+			}
+		}
+	}
+	tlsOn := t.SelfSigned || (t.CertFile != "" && t.KeyFile != "")
+	if t.RedirectPort != 0 {
+		ps.port("tls.redirectPort", t.RedirectPort, false)
+		if t.RedirectPort == cfg.Port {
+			ps.add("tls.redirectPort", "must differ from port")
+		}
+		if !tlsOn {
+			ps.add("tls.redirectPort", "has no effect without a certificate or selfSigned")
+		}
+	}
+	if t.ClientCAFile != "" {
+		if !tlsOn {
+			ps.add("tls.clientCAFile", "requires a certificate or selfSigned")
+		}
+		if ps.file("tls.clientCAFile", t.ClientCAFile) {
+			data, _ := os.ReadFile(t.ClientCAFile)
+			if !x509.NewCertPool().AppendCertsFromPEM(data) {
+				ps.add("tls.clientCAFile", "no PEM certificate found in %s", t.ClientCAFile)
+			}
+		}
+	}
+	if t.RequireClientCert && t.ClientCAFile == "" {
+		ps.add("tls.requireClientCert", "requires tls.clientCAFile, otherwise no downloader could authenticate")
+	}
+}
+
+func validateOIDCConfig(ps *configProblems, o tools.OIDCConfig) {
+	if o.Issuer == "" && o.ClientID == "" {
+		return
+	}
+	if o.Issuer == "" {
+		ps.add("oidc.issuer", "is required when oidc.clientId is set")
+	} else if u, err := url.Parse(o.Issuer); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		ps.add("oidc.issuer", "%q is not an http(s) URL", o.Issuer)
+	}
+	if o.ClientID == "" {
+		ps.add("oidc.clientId", "is required when oidc.issuer is set")
+	}
+	if o.RedirectURL != "" {
+		if u, err := url.Parse(o.RedirectURL); err != nil || !u.IsAbs() {
+			ps.add("oidc.redirectURL", "%q is not an absolute URL", o.RedirectURL)
+		}
+	}
+	if _, ok := roleRank[o.DefaultRole]; o.DefaultRole != "" && !ok {
+		ps.add("oidc.defaultRole", "unknown role %q, use admin, editor or viewer", o.DefaultRole)
+	}
+	claims := make([]string, 0, len(o.Roles))
+	for claim := range o.Roles {
+		claims = append(claims, claim)
+	}
+	sort.Strings(claims)
+	for _, claim := range claims {
+		role := o.Roles[claim]
+		if _, ok := roleRank[role]; !ok {
+			ps.add("oidc.roles."+claim, "unknown role %q, use admin, editor or viewer", role)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"bwrs/databases"
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+/*
+Download verification
+Every downloadsave local_address is checked on disk in the background,
+the result of the last check is kept in downloadsave_check so missing
+downloads can be listed and fetched again.
+*/
+
+var verifyJob = struct {
+	mu       sync.Mutex
+	running  bool
+	started  time.Time
+	finished time.Time
+	checked  int
+	counts   map[string]int
+	err      string
+}{
+	counts: make(map[string]int),
+}
+
+// verifyJobStatus snapshot of the current or last verification run
+func verifyJobStatus() map[string]interface{} {
+	verifyJob.mu.Lock()
+	defer verifyJob.mu.Unlock()
+	counts := make(map[string]int, len(verifyJob.counts))
+	for k, v := range verifyJob.counts {
+		counts[k] = v
+	}
+	st := map[string]interface{}{
+		"running": verifyJob.running,
+		"checked": verifyJob.checked,
+		"counts":  counts,
+		"error":   verifyJob.err,
+	}
+	if !verifyJob.started.IsZero() {
+		st["started"] = verifyJob.started.Format("2006-01-02 15:04:05")
+	}
+	if !verifyJob.finished.IsZero() {
+		st["finished"] = verifyJob.finished.Format("2006-01-02 15:04:05")
+	}
+	return st
+}
+
+// startVerifyJob runs a verification in the background, false when one is already running
+func startVerifyJob(database databases.Databases) bool {
+	verifyJob.mu.Lock()
+	if verifyJob.running {
+		verifyJob.mu.Unlock()
+		return false
+	}
+	verifyJob.running = true
+	verifyJob.started = time.Now()
+	verifyJob.finished = time.Time{}
+	verifyJob.checked = 0
+	verifyJob.counts = make(map[string]int)
+	verifyJob.err = ""
+	verifyJob.mu.Unlock()
+
+	goBackground(func(ctx context.Context) {
+		err := verifyDownloadSaves(ctx, database)
+		verifyJob.mu.Lock()
+		verifyJob.running = false
+		verifyJob.finished = time.Now()
+		took := verifyJob.finished.Sub(verifyJob.started)
+		if err != nil {
+			verifyJob.err = err.Error()
+		}
+		verifyJob.mu.Unlock()
+		if err != nil {
+			klog.Errorf("verify downloads failed: %v", err)
+		} else {
+			klog.Infof("verify downloads finished in %s", took.Round(time.Second))
+		}
+	})
+	return true
+}
+
+// verifyDownloadSaves checks page by page and stops between pages once ctx is cancelled
+func verifyDownloadSaves(ctx context.Context, database databases.Databases) error {
+	const pageSize = 500
+	var after int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		items, err := database.ListDownloadSavesAfter(ctx, after, pageSize)
+		if err != nil {
+			return err
+		}
+		if len(items) == 0 {
+			return nil
+		}
+		checks := make([]databases.DownloadSaveCheck, 0, len(items))
+		for _, d := range items {
+			checks = append(checks, checkLocalAddress(d))
+			after = d.Id
+		}
+		if err := database.SaveDownloadSaveChecks(ctx, checks); err != nil {
+			return err
+		}
+		verifyJob.mu.Lock()
+		verifyJob.checked += len(checks)
+		for _, ch := range checks {
+			verifyJob.counts[ch.Status]++
+		}
+		verifyJob.mu.Unlock()
+		if len(items) < pageSize {
+			return nil
+		}
+	}
+}
+
+// checkLocalAddress stats the local_address, directories are sized by the files they contain
+func checkLocalAddress(d databases.DownloadSave) databases.DownloadSaveCheck {
+	ch := databases.DownloadSaveCheck{DownloadId: d.Id, Name: d.Name, LocalAddress: d.LocalAddress}
+	p := strings.TrimSpace(d.LocalAddress)
+	if p == "" {
+		ch.Status = "empty"
+		return ch
+	}
+	info, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		ch.Status = "missing"
+		return ch
+	}
+	if err != nil {
+		ch.Status = "error"
+		ch.Error = err.Error()
+		return ch
+	}
+	ch.Status = "present"
+	if !info.IsDir() {
+		ch.Size = info.Size()
+		return ch
+	}
+	_ = filepath.WalkDir(p, func(path string, e fs.DirEntry, err error) error {
+		if err != nil || e.IsDir() {
+			return nil
+		}
+		if fi, err := e.Info(); err == nil {
+			ch.Size += fi.Size()
+		}
+		return nil
+	})
+	return ch
+}
+
+// scheduleVerifyJob starts a verification every interval, an empty or invalid interval disables it
+func scheduleVerifyJob(database databases.Databases, interval string) {
+	if interval == "" {
+		return
+	}
+	d, err := time.ParseDuration(interval)
+	if err != nil || d < time.Minute {
+		klog.Warningf("invalid downloadVerify.interval %q, scheduled verification disabled", interval)
+		return
+	}
+	goBackground(func(ctx context.Context) {
+		ticker := time.NewTicker(d)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if !startVerifyJob(database) {
+				klog.V(2).Info("verify downloads still running, skip scheduled run")
+			}
+		}
+	})
+}
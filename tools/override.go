@@ -0,0 +1,255 @@
+package tools
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+/*
+Config overrides
+Every scalar, list and map field of ServiceConfig can be overridden by an environment
+variable named after its yaml path, e.g. database.host -> LPT_DATABASE_HOST and
+tls.clientCAFile -> LPT_TLS_CLIENT_CA_FILE. When NAME_FILE is set instead of NAME the
+value is read from that file, so secrets can come from docker or kubernetes secrets.
+*/
+
+// EnvPrefix prefix of the environment variables overriding config fields
+const EnvPrefix = "LPT_"
+
+// envAliases short names for the most common secrets
+var envAliases = map[string]string{
+	"LPT_DATABASE_USERNAME": "database.description.username",
+	"LPT_DATABASE_PASSWORD": "database.description.password",
+}
+
+// ConfigField a field that can be overridden, Path is the dotted yaml path
+type ConfigField struct {
+	Path  string
+	Env   string
+	index []int
+}
+
+// ConfigFields lists the overridable fields in declaration order, lists of structs are skipped
+func ConfigFields() []ConfigField {
+	return collectFields(reflect.TypeOf(ServiceConfig{}), "", nil, false)
+}
+
+// collectFields with all set also returns lists of structs, which can be compared but not overridden
+func collectFields(t reflect.Type, prefix string, index []int, all bool) []ConfigField {
+	var out []ConfigField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name := yamlName(f)
+		if name == "" {
+			continue
+		}
+		path := name
+		if prefix != "" {
+			path = prefix + "." + name
+		}
+		idx := append(append([]int{}, index...), i)
+		switch {
+		case f.Type.Kind() == reflect.Struct:
+			out = append(out, collectFields(f.Type, path, idx, all)...)
+		case overridable(f.Type):
+			out = append(out, ConfigField{Path: path, Env: envName(path), index: idx})
+		case all:
+			out = append(out, ConfigField{Path: path, index: idx})
+		}
+	}
+	return out
+}
+
+// yamlName the key yaml.v3 uses for a field, the lowercased field name without a tag
+func yamlName(f reflect.StructField) string {
+	tag := strings.Split(f.Tag.Get("yaml"), ",")[0]
+	if tag == "-" {
+		return ""
+	}
+	if tag == "" {
+		return strings.ToLower(f.Name)
+	}
+	return tag
+}
+
+func overridable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Bool, reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	case reflect.Slice:
+		return t.Elem().Kind() == reflect.String
+	case reflect.Map:
+		return t.Key().Kind() == reflect.String && t.Elem().Kind() == reflect.String
+	case reflect.Ptr:
+		// optional scalars, nil means the key was absent
+		return t.Elem().Kind() != reflect.Ptr && t.Elem().Kind() != reflect.Struct && overridable(t.Elem())
+	}
+	return false
+}
+
+// envName converts a yaml path to LPT_ plus upper snake case, keeping acronyms together
+func envName(path string) string {
+	var b strings.Builder
+	b.WriteString(EnvPrefix)
+	for i, seg := range strings.Split(path, ".") {
+		if i > 0 {
+			b.WriteByte('_')
+		}
+		r := []rune(seg)
+		for j, c := range r {
+			if j > 0 && unicode.IsUpper(c) {
+				prev := r[j-1]
+				nextLower := j+1 < len(r) && unicode.IsLower(r[j+1])
+				if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+					b.WriteByte('_')
+				}
+			}
+			b.WriteRune(unicode.ToUpper(c))
+		}
+	}
+	return b.String()
+}
+
+/*
+SetConfigField
+Parses value for the field at path: lists are comma separated, maps are
+comma separated key=value pairs, integers are checked against the field size.
+*/
+func SetConfigField(cfg *ServiceConfig, path string, value string) error {
+	for _, f := range ConfigFields() {
+		if f.Path == path {
+			return setField(reflect.ValueOf(cfg).Elem().FieldByIndex(f.index), value)
+		}
+	}
+	return fmt.Errorf("unknown config field %s", path)
+}
+
+func setField(v reflect.Value, value string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		if v.OverflowInt(n) {
+			return fmt.Errorf("%d is out of range for a %d-bit integer", n, v.Type().Bits())
+		}
+		v.SetInt(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+		v.SetFloat(n)
+	case reflect.Slice:
+		list := []string{}
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				list = append(list, s)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	case reflect.Map:
+		m := map[string]string{}
+		for _, pair := range strings.Split(value, ",") {
+			if strings.TrimSpace(pair) == "" {
+				continue
+			}
+			k, val, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("invalid key=value pair %q", pair)
+			}
+			m[strings.TrimSpace(k)] = strings.TrimSpace(val)
+		}
+		v.Set(reflect.ValueOf(m))
+	case reflect.Ptr:
+		elem := reflect.New(v.Type().Elem())
+		if err := setField(elem.Elem(), value); err != nil {
+			return err
+		}
+		v.Set(elem)
+	default:
+		return fmt.Errorf("unsupported field type %s", v.Type())
+	}
+	return nil
+}
+
+// lookupEnv returns NAME, or the content of the file named by NAME_FILE without the trailing newline
+func lookupEnv(name string) (string, bool, error) {
+	if v, ok := os.LookupEnv(name); ok {
+		return v, true, nil
+	}
+	file, ok := os.LookupEnv(name + "_FILE")
+	if !ok {
+		return "", false, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", false, fmt.Errorf("%s_FILE: %v", name, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), true, nil
+}
+
+// ApplyEnvOverrides sets every field whose environment variable is present and reports all invalid values
+func ApplyEnvOverrides(cfg *ServiceConfig) error {
+	var errs []error
+	apply := func(env string, path string) {
+		value, ok, err := lookupEnv(env)
+		if err != nil {
+			errs = append(errs, err)
+			return
+		}
+		if !ok {
+			return
+		}
+		if err := SetConfigField(cfg, path, value); err != nil {
+			errs = append(errs, fmt.Errorf("%s (%s): %v", env, path, err))
+		}
+	}
+	for env, path := range envAliases {
+		apply(env, path)
+	}
+	for _, f := range ConfigFields() {
+		apply(f.Env, f.Path)
+	}
+	return errors.Join(errs...)
+}
+
+// ChangedConfigFields yaml paths of the fields whose values differ between a and b
+func ChangedConfigFields(a ServiceConfig, b ServiceConfig) []string {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	var changed []string
+	for _, f := range collectFields(va.Type(), "", nil, true) {
+		if !reflect.DeepEqual(va.FieldByIndex(f.index).Interface(), vb.FieldByIndex(f.index).Interface()) {
+			changed = append(changed, f.Path)
+		}
+	}
+	return changed
+}
+
+// CopyConfigField sets the field at path in dst to its value in src
+func CopyConfigField(dst *ServiceConfig, src ServiceConfig, path string) {
+	for _, f := range collectFields(reflect.TypeOf(src), "", nil, true) {
+		if f.Path == path {
+			reflect.ValueOf(dst).Elem().FieldByIndex(f.index).Set(reflect.ValueOf(src).FieldByIndex(f.index))
+			return
+		}
+	}
+}
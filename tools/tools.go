@@ -5,25 +5,133 @@ This is the global configuration or global variable
 */
 
 type ServiceConfig struct {
-	Port     int16 `yaml:"port"`
+	Port   int          `yaml:"port"`
+	Server ServerConfig `yaml:"server"`
+	Log    struct {
+		// Verbosity klog level 0-10 applied at startup and on reload, empty keeps --v
+		Verbosity string `yaml:"verbosity"`
+	} `yaml:"log"`
 	Database struct {
 		DataBaseType string `yaml:"databaseType"`
 		ConnPath     string `yaml:"connPath"`
 		//Type         string     `yaml:"type"`
 		Path        string     `yaml:"path"`
 		Host        string     `yaml:"host"`
-		Port        int16      `yaml:"port"`
+		Port        int        `yaml:"port"`
 		AuthSource  string     `yaml:"authSource"`
 		AuthType    string     `yaml:"authType"`
 		Description UserConfig `yaml:"description"`
 		BaseName    string     `yaml:"basename"`
+		// QueryTimeout bounds every database call, 30s when empty and "0" disables it
+		QueryTimeout string `yaml:"queryTimeout"`
 	}
 	Login struct {
 		User UserConfig
 	} `yaml:"login"`
+	OIDC    OIDCConfig `yaml:"oidc"`
+	TLS     TLSConfig  `yaml:"tls"`
+	Session struct {
+		// SameSite of the session cookies, lax (default) or strict
+		SameSite string `yaml:"sameSite"`
+		// BehindHTTPSProxy marks cookies Secure when TLS is terminated by a reverse proxy
+		BehindHTTPSProxy bool `yaml:"behindHTTPSProxy"`
+		// TrustedProxies addresses or CIDRs allowed to set X-Forwarded-For, empty trusts none
+		TrustedProxies []string `yaml:"trustedProxies"`
+	} `yaml:"session"`
+	AutoTag struct {
+		Rules []AutoTagRuleConfig `yaml:"rules"`
+	} `yaml:"autoTag"`
+	Downloader struct {
+		// AllowLegacyGet keeps the GET endpoints and the ask key in the query string working,
+		// unset means allowed so configs without a downloader block keep their old clients
+		AllowLegacyGet *bool `yaml:"allowLegacyGet"`
+	} `yaml:"downloader"`
+	RateLimit RateLimitConfig `yaml:"rateLimit"`
+	Audit     struct {
+		// RetentionDays audit log entries older than this are purged, 0 keeps them forever
+		RetentionDays int `yaml:"retentionDays"`
+	} `yaml:"audit"`
+	DownloadVerify struct {
+		Interval string `yaml:"interval"`
+	} `yaml:"downloadVerify"`
+}
+
+// ServerConfig HTTP server timeouts as durations like "30s", empty values use the defaults and "0" disables a timeout
+type ServerConfig struct {
+	ReadHeaderTimeout string `yaml:"readHeaderTimeout"`
+	ReadTimeout       string `yaml:"readTimeout"`
+	// WriteTimeout bounds whole responses including index builds and file downloads, disabled by default
+	WriteTimeout string `yaml:"writeTimeout"`
+	IdleTimeout  string `yaml:"idleTimeout"`
+	// ShutdownTimeout how long in-flight requests and background jobs may take after SIGTERM
+	ShutdownTimeout string `yaml:"shutdownTimeout"`
+}
+
+// RateLimitConfig token bucket settings, rates are requests per second and zero values use the defaults
+type RateLimitConfig struct {
+	IPRate           float64 `yaml:"ipRate"`
+	IPBurst          int     `yaml:"ipBurst"`
+	KeyRate          float64 `yaml:"keyRate"`
+	KeyBurst         int     `yaml:"keyBurst"`
+	MaxLoginFailures int     `yaml:"maxLoginFailures"`
+	LockoutDuration  string  `yaml:"lockoutDuration"`
+}
+
+// TLSConfig HTTPS serving, TLS is enabled when certFile and keyFile are set or selfSigned is true
+type TLSConfig struct {
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// SelfSigned generates a certificate for Hosts when the files do not exist yet
+	SelfSigned bool     `yaml:"selfSigned"`
+	Hosts      []string `yaml:"hosts"`
+	// RedirectPort plain HTTP port answering with a redirect to HTTPS, 0 disables it
+	RedirectPort int `yaml:"redirectPort"`
+	// ClientCAFile lets downloader clients authenticate with a certificate signed by this CA
+	ClientCAFile string `yaml:"clientCAFile"`
+	// RequireClientCert rejects downloader requests without a verified client certificate
+	RequireClientCert bool `yaml:"requireClientCert"`
+}
+
+// OIDCConfig OpenID Connect login, enabled when issuer and clientId are set
+type OIDCConfig struct {
+	Issuer       string `yaml:"issuer"`
+	ClientID     string `yaml:"clientId"`
+	ClientSecret string `yaml:"clientSecret"`
+	// RedirectURL must reach /api/oidc/callback, derived from the request when empty
+	RedirectURL string   `yaml:"redirectURL"`
+	Scopes      []string `yaml:"scopes"`
+	// DisplayName label of the login button
+	DisplayName string `yaml:"displayName"`
+	// UsernameClaim defaults to preferred_username, falling back to email and sub
+	UsernameClaim string `yaml:"usernameClaim"`
+	// RoleClaim string or list claim whose values are looked up in Roles, defaults to groups
+	RoleClaim string            `yaml:"roleClaim"`
+	Roles     map[string]string `yaml:"roles"`
+	// DefaultRole for users without a matching claim value, viewer when empty
+	DefaultRole string `yaml:"defaultRole"`
+	// AutoProvision creates a local user on the first login
+	AutoProvision bool `yaml:"autoProvision"`
+	// LinkExistingUsers lets the first login claim an unlinked local user named by a verified
+	// email or by LinkClaim, never by the username claim alone
+	LinkExistingUsers bool `yaml:"linkExistingUsers"`
+	// LinkClaim a claim the provider keeps unique and users cannot change, matched against local usernames
+	LinkClaim string `yaml:"linkClaim"`
 }
 
 type UserConfig struct {
 	Username string `yaml:"username"`
 	Password string `yaml:"password"`
 }
+
+// AutoTagRuleConfig a tagging rule declared in the config file,
+// every non-empty condition must match for the tags to be attached
+type AutoTagRuleConfig struct {
+	Name       string   `yaml:"name"`
+	Tags       []string `yaml:"tags"`
+	PathGlob   string   `yaml:"pathGlob"`
+	PathRegex  string   `yaml:"pathRegex"`
+	Extensions []string `yaml:"extensions"`
+	Camera     string   `yaml:"camera"`
+	DateFrom   string   `yaml:"dateFrom"`
+	DateTo     string   `yaml:"dateTo"`
+}